@@ -0,0 +1,93 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/star"
+)
+
+// catCmd represents the cat command
+var catCmd = &cobra.Command{
+	Use:   "cat <xxx.star|url> <files>",
+	Short: "Print content of files in a star file.",
+	Long: `Print content of files in a star file to stdout, following symlinks.
+
+Only the content of the given files is read, which makes a difference for
+star files read over http(s).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		catRun(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(catCmd)
+}
+
+func catRun(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		cmd.Help()
+		return
+	}
+
+	sr, err := openStar(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, name := range args[1:] {
+		if err := catFile(sr, name); err != nil {
+			fmt.Fprintf(os.Stderr, "star cat: %s\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func catFile(sr *star.Reader, name string) error {
+	fi, err := sr.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: is a directory", name)
+	}
+
+	info := fi.Sys().(*star.Info)
+	fr, err := sr.ReaderFor(info.Name)
+	if err != nil {
+		return err
+	}
+	if n, err := io.Copy(os.Stdout, fr); err != nil {
+		return fmt.Errorf("copying %q, written %d, err %w", name, n, err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// commitCmd represents the commit command
+var commitCmd = &cobra.Command{
+	Use:   "commit <upper-dir> <xxx.star|->",
+	Short: "Create a star layer from the upper dir of a writable mount.",
+	Long: `Create a star layer from the changes recorded in the upper dir of
+"star mount --upper", or of overlayfs. Files deleted are stored as whiteouts,
+so mounting the new layer over the star files mounted shows the changes.
+
+With --uid-map and --gid-map, as given to the mount, the ids of files are
+mapped back to those of the star files.
+
+The star file is written to stdout if given as "-".`,
+	Run: func(cmd *cobra.Command, args []string) {
+		commitRun(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(commitCmd)
+	addWriteFlags(commitCmd)
+	addIDMapFlags(commitCmd)
+}
+
+func commitRun(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Help()
+		return
+	}
+
+	fsr, err := fs.NewUpperReader(args[0])
+	if err != nil {
+		log.Fatalf("newing upper reader, %s", err)
+	}
+	uids, gids, err := getIDMapFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeStar(cmd, args[1], fs.UnmapIDs(fsr, uids, gids))
+}
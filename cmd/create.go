@@ -23,10 +23,14 @@ package cmd
 
 import (
 	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 
 	"github.com/sequix/star/pkg/fs"
@@ -35,10 +39,19 @@ import (
 
 // createCmd represents the create command
 var createCmd = &cobra.Command{
-	Use: "create <xxx.star> <files|yyy.tar>",
+	Use: "create <xxx.star|-> <files|yyy.tar>",
 	Aliases: []string{"c"},
 	Short: "Create a star file from files or a regular tar file.",
-	Long: `Create a star file from files or a regular tar file.`,
+	Long: `Create a star file from files or a regular tar file.
+
+Files are named by their paths as given, with leading "/" stripped like tar
+does, so absolute paths are extracted beneath the extraction directory.
+
+With --rootless, files are owned as recorded in the user.rootlesscontainers
+xattr by "star extract --rootless", or by root if nothing is recorded, and
+the empty files standing for device nodes are stored as the devices.
+
+The star file is written to stdout if given as "-".`,
 	Run: func(cmd *cobra.Command, args []string) {
 		createRun(cmd, args)
 	},
@@ -46,7 +59,17 @@ var createCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(createCmd)
-	createCmd.Flags().BoolP("force", "f", false, "Overwrite existing file")
+	addWriteFlags(createCmd)
+	createCmd.Flags().Bool("rootless", false, "Restore ownership and devices recorded by extract --rootless.")
+}
+
+// addWriteFlags adds the flags of writing a star file, see writeStar.
+func addWriteFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("force", "f", false, "Overwrite existing file")
+	cmd.Flags().Bool("dedup", true, "Store identical content once")
+	cmd.Flags().StringP("compression", "z", "", "Compress files with gzip or zstd")
+	cmd.Flags().String("chunk-size", humanize.IBytes(star.DefaultChunkSize), "Uncompressed size of independently compressed chunks")
+	cmd.Flags().String("order", "", "Place files of the access profile recorded by star mount --record first")
 }
 
 func createRun(cmd *cobra.Command, args []string) {
@@ -74,12 +97,51 @@ func createRun(cmd *cobra.Command, args []string) {
 			log.Fatalf("newing local reader, %s", err)
 		}
 	}
+	rootless, err := cmd.Flags().GetBool("rootless")
+	if err != nil {
+		log.Fatalf("getting flag --rootless, %s", err)
+	}
+	if rootless {
+		fsr = fs.RestoreRootless(fsr)
+	}
+	writeStar(cmd, sfn, fsr)
+}
 
+// writeStar writes the files of fsr to the star file sfn, or to stdout if it
+// is "-", as the flags added by addWriteFlags say.
+func writeStar(cmd *cobra.Command, sfn string, fsr fs.Reader) {
 	force, err := cmd.Flags().GetBool("force")
 	if err != nil {
 		log.Fatalf("getting flag --force, %s", err)
 	}
 
+	dedup, err := cmd.Flags().GetBool("dedup")
+	if err != nil {
+		log.Fatalf("getting flag --dedup, %s", err)
+	}
+	compression, err := cmd.Flags().GetString("compression")
+	if err != nil {
+		log.Fatalf("getting flag --compression, %s", err)
+	}
+	chunkSizeStr, err := cmd.Flags().GetString("chunk-size")
+	if err != nil {
+		log.Fatalf("getting flag --chunk-size, %s", err)
+	}
+	chunkSize, err := humanize.ParseBytes(chunkSizeStr)
+	if err != nil {
+		log.Fatalf("parsing flag --chunk-size, %s", err)
+	}
+	order, err := cmd.Flags().GetString("order")
+	if err != nil {
+		log.Fatalf("getting flag --order, %s", err)
+	}
+	var hot []string
+	if len(order) > 0 {
+		if hot, err = readProfile(order); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	flag := os.O_CREATE | os.O_WRONLY
 	if force {
 		flag |= os.O_TRUNC
@@ -87,14 +149,62 @@ func createRun(cmd *cobra.Command, args []string) {
 		flag |= os.O_EXCL
 	}
 
-	sf, err := os.OpenFile(sfn, flag, 0644)
-	if err != nil {
-		log.Fatalf("opening star file %q, %s", sfn, err)
+	sf := os.Stdout
+	if sfn != "-" {
+		sf, err = os.OpenFile(sfn, flag, 0644)
+		if err != nil {
+			log.Fatalf("opening star file %q, %s", sfn, err)
+		}
 	}
 
-	if err := star.WriteTo(sf, fsr); err != nil {
+	dir := os.TempDir()
+	if sfn != "-" {
+		dir = filepath.Dir(sfn)
+	}
+	if err := writeFiles(sf, fsr, dir, hot, dedup, compression, int(chunkSize)); err != nil {
 		log.Fatalf("creating star file %q, %s", sfn, err)
 	}
+	if err := sf.Close(); err != nil {
+		log.Fatalf("closing star file %q, %s", sfn, err)
+	}
 }
 
+// writeFiles writes the files of fsr to sf, with the files of the profile hot
+// first if not nil. Files come in the order of fsr, so with a profile the star
+// file is written to a temporary file in dir first, then repacked in the
+// order of the profile.
+func writeFiles(sf io.Writer, fsr fs.Reader, dir string, hot []string, dedup bool, compression string, chunkSize int) error {
+	out := sf
+	if hot != nil {
+		tf, err := ioutil.TempFile(dir, ".star-create-")
+		if err != nil {
+			return fmt.Errorf("creating temporary file, %w", err)
+		}
+		defer os.Remove(tf.Name())
+		defer tf.Close()
+		out = tf
+	}
 
+	sw := star.NewWriter(out)
+	sw.SetDedup(dedup)
+	if len(compression) > 0 && compression != "none" {
+		if err := sw.SetCompression(compression, chunkSize); err != nil {
+			return fmt.Errorf("setting compression, %w", err)
+		}
+	}
+	if err := sw.WriteFiles(fsr); err != nil {
+		return err
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	if out == sf {
+		return nil
+	}
+
+	sr, err := star.NewReader(out.(*os.File))
+	if err != nil {
+		return fmt.Errorf("newing star reader, %w", err)
+	}
+	return star.Repack(sf, sr, hot)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/fs"
+	"github.com/sequix/star/pkg/star"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export <xxx.star|url> <yyy.tar|->",
+	Short: "Convert a star file to a regular tar file.",
+	Long: `Convert a star file to a regular tar file, written to stdout if given as "-".
+
+Whiteouts and opaque directories are written in the OCI layer convention, so
+a star file created from a layer tar exports back to an equivalent layer tar.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		exportRun(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().BoolP("force", "f", false, "Overwrite existing file")
+}
+
+func exportRun(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Help()
+		return
+	}
+	sfn, tfn := args[0], args[1]
+
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		log.Fatalf("getting flag --force, %s", err)
+	}
+
+	sr, err := openStar(sfn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	flag := os.O_CREATE | os.O_WRONLY
+	if force {
+		flag |= os.O_TRUNC
+	} else {
+		flag |= os.O_EXCL
+	}
+
+	tf := os.Stdout
+	if tfn != "-" {
+		tf, err = os.OpenFile(tfn, flag, 0644)
+		if err != nil {
+			log.Fatalf("opening tar file %q, %s", tfn, err)
+		}
+	}
+
+	if err := export(tar.NewWriter(tf), sr); err != nil {
+		log.Fatalf("exporting %q to %q, %s", sfn, tfn, err)
+	}
+	if err := tf.Close(); err != nil {
+		log.Fatalf("closing tar file %q, %s", tfn, err)
+	}
+}
+
+// export writes the files of sr to tw in the order they are stored.
+func export(tw *tar.Writer, sr *star.Reader) error {
+	for _, fi := range sr.ListFiles() {
+		th := fs.TarHeader(fi.FileInfo)
+		if err := tw.WriteHeader(th); err != nil {
+			return fmt.Errorf("writing header of %q, %w", fi.Name, err)
+		}
+		if th.Typeflag != tar.TypeReg || th.Size == 0 {
+			continue
+		}
+
+		fr, err := sr.ReaderForInfo(fi)
+		if err != nil {
+			return err
+		}
+		if n, err := io.Copy(tw, fr); err != nil {
+			return fmt.Errorf("copying %q, written %d, err %w", fi.Name, n, err)
+		}
+	}
+	return tw.Close()
+}
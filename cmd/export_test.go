@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sequix/star/pkg/fs"
+	"github.com/sequix/star/pkg/star"
+)
+
+func TestExportWhiteouts(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	headers := []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/.wh.hosts", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: ".wh.var", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, th := range headers {
+		th.ModTime = mtime
+		if err := tw.WriteHeader(th); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(bytes.Repeat([]byte("x"), int(th.Size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sbuf bytes.Buffer
+	sw := star.NewWriter(&sbuf)
+	if err := sw.WriteFiles(fs.NewTarReader(tar.NewReader(&layer))); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := star.NewReader(bytes.NewReader(sbuf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exported bytes.Buffer
+	if err := export(tar.NewWriter(&exported), sr); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		name     string
+		typeflag byte
+		content  string
+	}
+	var want, got []entry
+	for _, th := range headers {
+		want = append(want, entry{th.Name, th.Typeflag, string(bytes.Repeat([]byte("x"), int(th.Size)))})
+	}
+	tr := tar.NewReader(&exported)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry{th.Name, th.Typeflag, string(content)})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("exported, want %v, got %v", want, got)
+	}
+}
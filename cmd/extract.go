@@ -27,6 +27,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/spf13/cobra"
 
@@ -36,10 +37,32 @@ import (
 
 // extractCmd represents the extract command
 var extractCmd = &cobra.Command{
-	Use:   "extract <xxx.star>",
+	Use:   "extract <xxx.star|url> [names|patterns]",
 	Aliases: []string{"x"},
 	Short: "Extract a star file.",
-	Long: `Extract a star file.`,
+	Long: `Extract a star file, or the given entries and what is beneath them.
+
+Entries are given by names or glob patterns, e.g. "etc/*.conf", as given or
+read from the file of --files-from, one per line. Entries matching patterns
+of --exclude are not extracted, patterns without a "/" matching any
+component of names. Only the content of the entries extracted is read, which
+makes a difference for star files read over http(s). Hard links to files not
+extracted are extracted as copies of the files.
+
+With --uid-map and --gid-map, files are owned by the mapped ids, e.g. to
+extract a rootfs for a user namespace. Ids mapped by no range are owned by
+the overflow ids, 65534 by default.
+
+With --rootless, a user without privileges extracts files owned by that user.
+The ownership of files, and the device of device nodes, are recorded in the
+user.rootlesscontainers xattr instead, as umoci does, device nodes are
+created as empty regular files, and xattrs not settable are skipped.
+"star create --rootless" restores what is recorded.
+
+Files are written beneath the directory of -C, the current directory by
+default, only: names climbing out of it, absolute names, and files written
+through symlinks pointing out of it are rejected, unless --unsafe-paths is
+given.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		extractRun(cmd, args)
 	},
@@ -47,67 +70,351 @@ var extractCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(extractCmd)
+	addCacheFlags(extractCmd)
+	addIDMapFlags(extractCmd)
+	extractCmd.Flags().Bool("rootless", false, "Skip privileged operations, recording ownership and devices in xattrs.")
+	extractCmd.Flags().Bool("unsafe-paths", false, "Write files where named, even out of the directory extracted to.")
+	extractCmd.Flags().StringP("directory", "C", "", "Extract to this directory instead of the current one.")
+	extractCmd.Flags().StringArray("exclude", nil, "Skip entries matching this pattern, repeatable.")
+	extractCmd.Flags().Int("strip-components", 0, "Strip this number of leading components off names.")
+	extractCmd.Flags().String("files-from", "", `Extract the entries named in this file, one per line, "-" for stdin.`)
 }
 
 func extractRun(cmd *cobra.Command, args []string) {
-	if len(args) != 1 {
+	if len(args) < 1 {
 		cmd.Help()
 		return
 	}
+	flags := cmd.Flags()
 
-	sfr, err := os.Open(args[0])
+	cc, err := getCacheFlags(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	uids, gids, err := getIDMapFlags(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rootless, err := flags.GetBool("rootless")
+	if err != nil {
+		fmt.Printf("getting flag --rootless, %s\n", err)
+		return
+	}
+	opts := &fs.WriteOptions{Rootless: rootless}
+	unsafePaths, err := flags.GetBool("unsafe-paths")
+	if err != nil {
+		fmt.Printf("getting flag --unsafe-paths, %s\n", err)
+		return
+	}
+	dir, err := flags.GetString("directory")
+	if err != nil {
+		fmt.Printf("getting flag --directory, %s\n", err)
+		return
+	}
+	if len(dir) == 0 {
+		dir = "."
+	}
+	excludes, err := flags.GetStringArray("exclude")
+	if err != nil {
+		fmt.Printf("getting flag --exclude, %s\n", err)
+		return
+	}
+	strip, err := flags.GetInt("strip-components")
+	if err != nil {
+		fmt.Printf("getting flag --strip-components, %s\n", err)
+		return
+	}
+	filesFrom, err := flags.GetString("files-from")
+	if err != nil {
+		fmt.Printf("getting flag --files-from, %s\n", err)
+		return
+	}
+	patterns := args[1:]
+	if len(filesFrom) > 0 {
+		names, err := readMemberNames(filesFrom)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		patterns = append(patterns, names...)
+	}
+	ms, err := newMembers(patterns, excludes, strip)
 	if err != nil {
-		fmt.Printf("opening file %q: %s\n", args[0], err)
+		fmt.Println(err)
 		return
 	}
 
-	sr, err := star.NewReader(sfr)
+	sr, cache, err := openStarCached(args[0], cc)
 	if err != nil {
-		fmt.Printf("newing star reader: %s\n", err)
+		fmt.Println(err)
 		return
 	}
+	defer logCacheStats(cache)
 
-	for _, fi := range sr.ListFiles() {
-		fr, err := sr.ReaderFor(fi.Name)
-		if err != nil {
-			fmt.Printf("selecting file read %q: %s\n", fi.Name, err)
+	entries := pickEntries(sr, ms)
+	if unmatched := ms.unmatched(); len(unmatched) > 0 {
+		for _, p := range unmatched {
+			fmt.Printf("%q not found in star file\n", p)
+		}
+		return
+	}
+
+	var root *fs.Root
+	if unsafePaths {
+		if err := os.Chdir(dir); err != nil {
+			fmt.Printf("changing to directory %q, %s\n", dir, err)
+			return
+		}
+	} else {
+		if root, err = fs.OpenRoot(dir); err != nil {
+			fmt.Println(err)
 			return
 		}
-		if err := write(fi, fr); err != nil {
+		defer root.Close()
+	}
+
+	// Whiteouts delete files of lower layers only, so they are applied before
+	// any file of this layer is written.
+	for _, e := range entries {
+		fi := e.fi
+		if fi.Kind != fs.KindWhiteout && fi.Kind != fs.KindOpaque {
+			continue
+		}
+		log.Println("whiteout", fs.WhiteoutName(fi.FileInfo))
+		if err := applyWhiteout(root, fi); err != nil {
+			fmt.Printf("applying whiteout %q: %s\n", fi.Name, err)
+			return
+		}
+	}
+
+	var dirs []*star.Info
+	for _, e := range entries {
+		fi := e.fi
+		if fi.Kind == fs.KindWhiteout || fi.Kind == fs.KindOpaque {
+			continue
+		}
+		// Only the content of regular files is read.
+		var fr io.Reader
+		if fi.Mode.IsRegular() && fi.Kind == fs.KindNormal {
+			if fr, err = sr.ReaderForInfo(e.src); err != nil {
+				fmt.Printf("selecting file read %q: %s\n", e.src.Name, err)
+				return
+			}
+		}
+		mapped := mapIDs(fi, uids, gids)
+		if err := write(root, mapped, fr, opts); err != nil {
 			fmt.Printf("writing %q: %s\n", fi.Name, err)
 			return
 		}
+		if fi.Mode.IsDir() {
+			dirs = append(dirs, mapped)
+		}
+	}
+
+	// Directories stay writable while files are written into them, and get
+	// their modes last, children, listed after their parents, first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := restoreDirMode(root, dirs[i], opts); err != nil {
+			fmt.Printf("restoring mode of %q: %s\n", dirs[i].Name, err)
+			return
+		}
 	}
 }
 
-func write(fi *star.Info, data io.Reader) error {
-	switch fi.Mode & os.ModeType {
+// entry is an entry of a star file to extract, named as extracted, with the
+// info of the file holding its content in the star file.
+type entry struct {
+	fi  *star.Info
+	src *star.Info
+}
+
+// pickEntries returns the entries of sr selected by ms, in the order they
+// are stored.
+func pickEntries(sr *star.Reader, ms *members) []entry {
+	var (
+		entries []entry
+		infos   = map[string]*star.Info{}
+		// Names extracted as, of the entries picked.
+		picked = map[string]string{}
+	)
+	for _, fi := range sr.ListFiles() {
+		key := star.CleanName(fi.Name)
+		infos[key] = fi
+		name, ok := ms.pick(fi.Name)
+		if !ok {
+			continue
+		}
+		picked[key] = name
+
+		e := entry{fi: renameInfo(fi, name), src: fi}
+		if fi.Kind == fs.KindHardlink {
+			// Targets are stored before their hard links.
+			if target, ok := picked[star.CleanName(fi.Linkname)]; ok {
+				e.fi.Linkname = target
+			} else if target, ok := infos[star.CleanName(fi.Linkname)]; ok {
+				e = entry{fi: renameInfo(target, name), src: target}
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// renameInfo returns a copy of fi named name, or fi itself if it is named
+// so.
+func renameInfo(fi *star.Info, name string) *star.Info {
+	if fi.Name == name {
+		return fi
+	}
+	renamed := *fi
+	renamedFI := *fi.FileInfo
+	renamedFI.Name = name
+	renamed.FileInfo = &renamedFI
+	return &renamed
+}
+
+// applyWhiteout applies the whiteout fi beneath root, or where named if root
+// is nil.
+func applyWhiteout(root *fs.Root, fi *star.Info) error {
+	bfi, done, err := beneath(root, fi.FileInfo)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return fs.ApplyWhiteout(bfi)
+}
+
+// write writes the file fi beneath root, or where named if root is nil.
+func write(root *fs.Root, fi *star.Info, data io.Reader, opts *fs.WriteOptions) error {
+	dir := filepath.Dir(fi.Name)
+	if root == nil {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("mkdirall %q, %s", dir, err)
+		}
+	} else if err := root.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	bfi, done, err := beneath(root, fi.FileInfo)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// Files of a layer replace those of lower layers.
+	if !bfi.Mode.IsDir() {
+		if err := removeExisting(bfi.Name); err != nil {
+			return err
+		}
+	}
+
+	if bfi.Kind == fs.KindHardlink {
+		return fs.Link(bfi)
+	}
+
+	switch bfi.Mode & os.ModeType {
 	case os.ModeDir:
-		return fs.MkdirAll(fi.FileInfo)
+		return fs.MkdirAll(bfi, opts)
 	case os.ModeSymlink:
-		return fs.Symlink(fi.FileInfo)
+		return fs.Symlink(bfi, opts)
 	case os.ModeDevice | os.ModeCharDevice, os.ModeDevice:
-		return fs.Mknod(fi.FileInfo)
+		return fs.Mknod(bfi, opts)
 	}
 
 	log.Println("file", fi.Name)
 
-	dir := filepath.Dir(fi.Name)
-	if err := os.MkdirAll(dir, 0655); err != nil {
-		return fmt.Errorf("mkdirall %q, %s", dir, err)
+	fw, err := os.OpenFile(bfi.Name, os.O_CREATE|os.O_WRONLY|os.O_EXCL|syscall.O_NOFOLLOW, bfi.Mode)
+	if err != nil {
+		return fmt.Errorf("open file %q, %s", fi.Name, err)
 	}
 
-	fw, err := os.OpenFile(fi.Name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, fi.Mode)
+	n, err := io.Copy(fw, data)
 	if err != nil {
-		return fmt.Errorf("open file %q, %s", fi.Name, err)
+		fw.Close()
+		return fmt.Errorf("copy to file %q, copied %d byte, err %s", fi.Name, n, err)
 	}
-	if err := fs.Chall(fi.FileInfo); err != nil {
+	if err := fw.Close(); err != nil {
+		return fmt.Errorf("close file %q, %s", fi.Name, err)
+	}
+
+	// After the content is written, which would drop security.capability
+	// and touch the mtime.
+	if err := fs.Chall(bfi, opts); err != nil {
 		return fmt.Errorf("chall file %q, %s", fi.Name, err)
 	}
+	return nil
+}
 
-	n, err := io.Copy(fw, data)
+// restoreDirMode restores the mode of the directory fi written beneath root,
+// see fs.RestoreDirMode.
+func restoreDirMode(root *fs.Root, fi *star.Info, opts *fs.WriteOptions) error {
+	bfi, done, err := beneath(root, fi.FileInfo)
 	if err != nil {
-		return fmt.Errorf("copy to file %q, copied %d byte, err %s", fi.Name, n, err)
+		return err
+	}
+	defer done()
+	return fs.RestoreDirMode(bfi, opts)
+}
+
+// beneath returns a copy of fi named by paths resolved beneath root, see
+// fs.Root.Resolve, and a func to call once done with the copy. With no
+// root, fi is returned as is.
+func beneath(root *fs.Root, fi *fs.FileInfo) (*fs.FileInfo, func(), error) {
+	if root == nil {
+		return fi, func() {}, nil
+	}
+
+	var (
+		bfi     = *fi
+		parents []*os.File
+		done    = func() {
+			for _, parent := range parents {
+				parent.Close()
+			}
+		}
+	)
+	name, parent, err := root.Resolve(fi.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	bfi.Name, parents = name, append(parents, parent)
+
+	// Hard links must link to files beneath root too, while symlinks are
+	// not followed, so they point anywhere.
+	if fi.Kind == fs.KindHardlink {
+		linkname, parent, err := root.Resolve(fi.Linkname)
+		if err != nil {
+			done()
+			return nil, nil, err
+		}
+		bfi.Linkname, parents = linkname, append(parents, parent)
+	}
+	return &bfi, done, nil
+}
+
+// mapIDs returns a copy of fi owned by the mapped ids, see fs.MapIDs.
+func mapIDs(fi *star.Info, uids, gids *fs.IDMap) *star.Info {
+	if uids == nil && gids == nil {
+		return fi
+	}
+	mapped := *fi
+	mapped.FileInfo = fs.MapIDs(fi.FileInfo, uids, gids)
+	return &mapped
+}
+
+// removeExisting removes the file name if it exists and is not a directory.
+func removeExisting(name string) error {
+	st, err := os.Lstat(name)
+	if os.IsNotExist(err) || err == nil && st.IsDir() {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("lstat %q, %s", name, err)
+	}
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("remove %q, %s", name, err)
 	}
 	return nil
 }
@@ -0,0 +1,79 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+func addIDMapFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("uid-map", nil, `Map uids of files as "<inside> <outside> <count>" like /proc/self/uid_map, or a file of such lines, repeatable.`)
+	cmd.Flags().StringArray("gid-map", nil, `Map gids of files like --uid-map.`)
+}
+
+// getIDMapFlags returns the maps of uids and gids given, nil for those not
+// given. Ids mapped by no range are clamped to the overflow ids of the
+// kernel.
+func getIDMapFlags(cmd *cobra.Command) (uids, gids *fs.IDMap, err error) {
+	if uids, err = getIDMapFlag(cmd, "uid-map", fs.OverflowUID()); err != nil {
+		return nil, nil, err
+	}
+	if gids, err = getIDMapFlag(cmd, "gid-map", fs.OverflowGID()); err != nil {
+		return nil, nil, err
+	}
+	return uids, gids, nil
+}
+
+func getIDMapFlag(cmd *cobra.Command, name string, overflow uint32) (*fs.IDMap, error) {
+	values, err := cmd.Flags().GetStringArray(name)
+	if err != nil {
+		return nil, fmt.Errorf("getting flag --%s, %w", name, err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	lines := make([]string, 0, len(values))
+	for _, value := range values {
+		// A value of a single word names a file of lines, e.g.
+		// /proc/self/uid_map.
+		if len(strings.Fields(value)) == 1 {
+			content, err := ioutil.ReadFile(value)
+			if err != nil {
+				return nil, fmt.Errorf("reading flag --%s, %w", name, err)
+			}
+			value = string(content)
+		}
+		lines = append(lines, value)
+	}
+	m, err := fs.ParseIDMap(strings.Join(lines, "\n"), overflow)
+	if err != nil {
+		return nil, fmt.Errorf("parsing flag --%s, %w", name, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// infoCmd represents the info command
+var infoCmd = &cobra.Command{
+	Use:   "info <xxx.star|url>",
+	Short: "Print summary of a star file.",
+	Long: `Print summary of a star file, including entries by type, content size,
+and bytes saved by dedup and compression.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		infoRun(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+}
+
+func infoRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Help()
+		return
+	}
+
+	sr, err := openStar(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var (
+		files, dirs, symlinks, hardlinks, whiteouts, others int
+		// Content size of regular files, not counting hard links.
+		contentSize uint64
+		// Size of unique content before and after compression.
+		uniqueSize, storedSize uint64
+		dedupFiles             int
+		dedupSaved             uint64
+		payloads               = map[uint64]bool{}
+	)
+	for _, fi := range sr.ListFiles() {
+		switch {
+		case fi.Kind == fs.KindHardlink:
+			hardlinks++
+			continue
+		case fi.Kind == fs.KindWhiteout || fi.Kind == fs.KindOpaque:
+			whiteouts++
+			continue
+		case fi.Mode.IsRegular():
+			files++
+		case fi.Mode.IsDir():
+			dirs++
+			continue
+		case fi.Mode&os.ModeSymlink != 0:
+			symlinks++
+			continue
+		default:
+			others++
+			continue
+		}
+
+		contentSize += fi.Size
+		if fi.Size == 0 {
+			continue
+		}
+		if payloads[fi.Offset] {
+			dedupFiles++
+			dedupSaved += fi.StoredSize()
+			continue
+		}
+		payloads[fi.Offset] = true
+		uniqueSize += fi.Size
+		storedSize += fi.StoredSize()
+	}
+
+	// Version1 is stored as 0.
+	fmt.Printf("version:     %d\n", sr.Version()+1)
+	fmt.Printf("entries:     %d files, %d dirs, %d symlinks, %d hard links, %d whiteouts, %d others\n",
+		files, dirs, symlinks, hardlinks, whiteouts, others)
+	fmt.Printf("content:     %s (%d bytes)\n", humanize.IBytes(contentSize), contentSize)
+	fmt.Printf("stored:      %s (%d bytes)\n", humanize.IBytes(storedSize), storedSize)
+	fmt.Printf("dedup:       %d files, saved %s (%d bytes)\n", dedupFiles, humanize.IBytes(dedupSaved), dedupSaved)
+	fmt.Printf("compression: %s of unique content stored in %s\n", humanize.IBytes(uniqueSize), humanize.IBytes(storedSize))
+	if end := sr.HotEnd(); end > 0 {
+		fmt.Printf("hot files:   first %s (%d bytes)\n", humanize.IBytes(uint64(end)), end)
+	}
+}
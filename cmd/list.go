@@ -29,12 +29,13 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 
+	"github.com/sequix/star/pkg/fs"
 	"github.com/sequix/star/pkg/star"
 )
 
 // listCmd represents the list command
 var listCmd = &cobra.Command{
-	Use:     "list <xxx.star>",
+	Use:     "list <xxx.star|url>",
 	Aliases: []string{"t"},
 	Short:   "List content of a star file.",
 	Long:    `List content of a star file.`,
@@ -58,16 +59,9 @@ func listRun(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	sfn := args[0]
-	sf, err := os.Open(sfn)
+	sfr, err := openStar(args[0])
 	if err != nil {
-		fmt.Printf("opening star file %q, %s\n", sfn, err)
-		return
-	}
-
-	sfr, err := star.NewReader(sf)
-	if err != nil {
-		fmt.Printf("newing star reader, %s\n", err)
+		fmt.Println(err)
 		return
 	}
 
@@ -191,7 +185,13 @@ func printFileInfo(fi *star.Info, human, basename bool, timeKind string) {
 		fmt.Printf("%s", fi.Name)
 	}
 
-	if len(fi.Linkname) > 0 {
+	if fi.Kind == fs.KindHardlink {
+		fmt.Printf(" link to %s", fi.Linkname)
+	} else if fi.Kind == fs.KindWhiteout {
+		fmt.Printf(" (whiteout)")
+	} else if fi.Kind == fs.KindOpaque {
+		fmt.Printf(" (opaque)")
+	} else if len(fi.Linkname) > 0 {
 		fmt.Printf(" -> %s", fi.Linkname)
 	}
 	fmt.Println()
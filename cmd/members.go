@@ -0,0 +1,170 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sequix/star/pkg/star"
+)
+
+// members selects entries of a star file by names or glob patterns, and
+// renames them, as the arguments of tar do.
+type members struct {
+	// Names or patterns selecting entries and what is beneath them, all
+	// entries if empty.
+	patterns []string
+	matched  []bool
+	// Patterns of entries not selected, matching names or, without a "/",
+	// any component of names.
+	excludes []string
+	// Leading components stripped off names.
+	strip int
+}
+
+func newMembers(patterns, excludes []string, strip int) (*members, error) {
+	if strip < 0 {
+		return nil, fmt.Errorf("invalid --strip-components %d", strip)
+	}
+	m := &members{
+		matched: make([]bool, len(patterns)),
+		strip:   strip,
+	}
+	for _, p := range patterns {
+		p = star.CleanName(p)
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("parsing pattern %q, %w", p, err)
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	for _, p := range excludes {
+		p = star.CleanName(p)
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("parsing pattern %q of --exclude, %w", p, err)
+		}
+		m.excludes = append(m.excludes, p)
+	}
+	return m, nil
+}
+
+// readMemberNames reads names one per line from the file name, or stdin if
+// it is "-".
+func readMemberNames(name string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("opening %q, %w", name, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var names []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); len(line) > 0 {
+			names = append(names, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %q, %w", name, err)
+	}
+	return names, nil
+}
+
+// pick returns the name to extract the entry name as, or false if it is
+// not selected, or stripped off entirely.
+func (m *members) pick(name string) (string, bool) {
+	key := star.CleanName(name)
+	if len(m.patterns) > 0 {
+		picked := false
+		for i, p := range m.patterns {
+			if matchMember(p, key) {
+				m.matched[i], picked = true, true
+			}
+		}
+		if !picked {
+			return "", false
+		}
+	}
+	for _, p := range m.excludes {
+		if matchMember(p, key) || !strings.Contains(p, "/") && matchComponent(p, key) {
+			return "", false
+		}
+	}
+	return m.rename(name)
+}
+
+// rename returns name with the leading components stripped off, or false
+// if nothing is left. Names are not cleaned otherwise, so unsafe ones are
+// still rejected as extracted.
+func (m *members) rename(name string) (string, bool) {
+	if m.strip == 0 {
+		return name, true
+	}
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	for i := 0; i < m.strip; i++ {
+		j := strings.IndexByte(name, '/')
+		if j < 0 {
+			return "", false
+		}
+		name = name[j+1:]
+	}
+	return name, name != "."
+}
+
+// unmatched returns the patterns which selected no entry.
+func (m *members) unmatched() []string {
+	var ps []string
+	for i, p := range m.patterns {
+		if !m.matched[i] {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// matchMember reports whether pattern matches name, or a directory of it.
+func matchMember(pattern, name string) bool {
+	for ; name != "."; name = path.Dir(name) {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchComponent reports whether pattern matches a component of name.
+func matchComponent(pattern, name string) bool {
+	for _, comp := range strings.Split(name, "/") {
+		if ok, _ := path.Match(pattern, comp); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMembersPick(t *testing.T) {
+	for _, tc := range []struct {
+		patterns, excludes []string
+		strip              int
+		// Names picked, as extracted, or "-" if not picked.
+		want map[string]string
+	}{
+		{
+			want: map[string]string{"etc/hosts": "etc/hosts", "./etc/passwd": "./etc/passwd"},
+		},
+		{
+			patterns: []string{"etc", "/usr/bin/*"},
+			want: map[string]string{
+				"./etc":        "./etc",
+				"etc/hosts":    "etc/hosts",
+				"usr/bin/env":  "usr/bin/env",
+				"usr/bin/x/y":  "usr/bin/x/y",
+				"usr/lib/libc": "-",
+				"etcetera":     "-",
+			},
+		},
+		{
+			excludes: []string{"*.log", "var/cache"},
+			want: map[string]string{
+				"a.log":            "-",
+				"var/log/x.log":    "-",
+				"var/log/x.log/y":  "-",
+				"var/cache/a":      "-",
+				"srv/var/cache/a":  "srv/var/cache/a",
+				"var/log/messages": "var/log/messages",
+			},
+		},
+		{
+			strip: 1,
+			want: map[string]string{
+				"rootfs":          "-",
+				"./rootfs":        "-",
+				"rootfs/":         "-",
+				"rootfs/etc":      "etc",
+				"./rootfs/etc/a":  "etc/a",
+				"/rootfs/etc/a/":  "etc/a",
+				"rootfs/../x/y/z": "y/z",
+			},
+		},
+		{
+			patterns: []string{"rootfs/etc"},
+			excludes: []string{"shadow"},
+			strip:    2,
+			want: map[string]string{
+				"rootfs/etc":        "-",
+				"rootfs/etc/hosts":  "hosts",
+				"rootfs/etc/shadow": "-",
+				"rootfs/usr/bin":    "-",
+			},
+		},
+	} {
+		t.Run(fmt.Sprint(tc.patterns, tc.excludes, tc.strip), func(t *testing.T) {
+			m, err := newMembers(tc.patterns, tc.excludes, tc.strip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tc.want {
+				got, ok := m.pick(name)
+				if !ok {
+					got = "-"
+				}
+				if got != want {
+					t.Errorf("pick %q, want %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMembersUnmatched(t *testing.T) {
+	m, err := newMembers([]string{"etc", "missing", "./usr/*"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/hosts", "usr/bin"} {
+		m.pick(name)
+	}
+	if got := m.unmatched(); len(got) != 1 || got[0] != "missing" {
+		t.Errorf("want only \"missing\" unmatched, got %q", got)
+	}
+
+	for _, tc := range []struct {
+		patterns, excludes []string
+		strip              int
+	}{
+		{[]string{"[a"}, nil, 0},
+		{nil, []string{"[a"}, 0},
+		{nil, nil, -1},
+	} {
+		if _, err := newMembers(tc.patterns, tc.excludes, tc.strip); err == nil {
+			t.Errorf("newMembers(%q, %q, %d), want error", tc.patterns, tc.excludes, tc.strip)
+		}
+	}
+}
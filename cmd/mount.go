@@ -22,20 +22,338 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/fs"
+	"github.com/sequix/star/pkg/star"
 )
 
+// envDaemonChild marks the re-executed process serving a --daemon mount.
+// The parent passes the write end of a pipe as fd 3, the child reports
+// "ok" or the error through it once mounted.
+const envDaemonChild = "_STAR_MOUNT_DAEMON"
+
 // mountCmd represents the mount command
 var mountCmd = &cobra.Command{
-	Use:   "mount",
-	Short: "Mount a star file read-only.",
-	Long: `Mount a star file read-only.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	Use:   "mount <xxx.star|url>... <mountpoint>",
+	Short: "Mount star files.",
+	Long: `Mount star files read-only, or writable with --upper.
+
+Several star files are mounted as the layers of a container image, given from
+the lowest layer to the uppermost. Files of upper layers replace those of
+lower layers, whiteouts hide lower files, and opaque directories hide the
+lower content of the directory.
+
+With --upper, changes go to the upper dir, files modified are copied there
+first, and files deleted are recorded as whiteouts. "star commit" turns the
+upper dir into a new star layer.
 
+With --uid-map and --gid-map, the ids of files are shown mapped, e.g. to the
+ids of a user namespace, and files copied up to the upper dir are owned by
+the mapped ids.
+
+With --daemon, mount returns once the filesystem is being served in the
+background, and the daemon's pid is written to the pidfile. The daemon
+unmounts on SIGTERM or SIGINT, see "star umount".`,
+	Run: func(cmd *cobra.Command, args []string) {
+		mountRun(cmd, args)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(mountCmd)
 	mountCmd.Flags().BoolP("daemon", "d", false, "Run as daemon.")
+	mountCmd.Flags().StringP("pidfile", "p", "", "Pidfile of the daemon, default derived from mountpoint.")
+	addCacheFlags(mountCmd)
+	mountCmd.Flags().Bool("prefetch", false, "Fetch the whole remote star files into the cache in background.")
+	mountCmd.Flags().StringSlice("prefetch-file", nil, "Fetch these files first, only them without --prefetch.")
+	mountCmd.Flags().String("prefetch-rate", "0", "Limit prefetching to bytes per second, 0 for no limit.")
+	mountCmd.Flags().String("prefetch-status", "", "File to write the prefetch progress to as JSON.")
+	mountCmd.Flags().String("record", "", "File to write the trace of files read to as JSON once unmounted.")
+	mountCmd.Flags().String("upper", "", "Mount writable, keeping changes in this dir.")
+	addIDMapFlags(mountCmd)
+}
+
+func mountRun(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		cmd.Help()
+		return
+	}
+	sfns, mntpoint := args[:len(args)-1], args[len(args)-1]
+
+	flags := cmd.Flags()
+	daemon, err := flags.GetBool("daemon")
+	if err != nil {
+		log.Fatalf("getting flag --daemon, %s", err)
+	}
+	pidfile, err := flags.GetString("pidfile")
+	if err != nil {
+		log.Fatalf("getting flag --pidfile, %s", err)
+	}
+	if len(pidfile) == 0 {
+		pidfile = defaultPidfile(mntpoint)
+	}
+	cc, err := getCacheFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pc, err := getPrefetchFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	record, err := flags.GetString("record")
+	if err != nil {
+		log.Fatalf("getting flag --record, %s", err)
+	}
+	upper, err := flags.GetString("upper")
+	if err != nil {
+		log.Fatalf("getting flag --upper, %s", err)
+	}
+	uids, gids, err := getIDMapFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := &star.MountOptions{Upper: upper, UIDMap: uids, GIDMap: gids}
+	if pc != nil && len(cc.dir) == 0 {
+		// Prefetched blocks are kept on disk, so they outlive the memory.
+		if cc.dir, err = defaultCacheDir(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch {
+	case os.Getenv(envDaemonChild) == "1":
+		ready := os.NewFile(3, "ready")
+		err := serveMount(sfns, mntpoint, pidfile, record, opts, cc, pc, func() {
+			fmt.Fprint(ready, "ok")
+			ready.Close()
+		})
+		if err != nil {
+			fmt.Fprint(ready, err)
+			os.Exit(1)
+		}
+	case daemon:
+		if err := startDaemon(); err != nil {
+			log.Fatalf("starting mount daemon, %s", err)
+		}
+	default:
+		if err := serveMount(sfns, mntpoint, "", record, opts, cc, pc, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// serveMount mounts the layers sfns at mntpoint with opts, and serves until
+// unmounted or signaled. The pidfile is written if
+// given, the trace of files read is written to record once unmounted if
+// given, and ready is called once serving.
+func serveMount(sfns []string, mntpoint, pidfile, record string, opts *star.MountOptions, cc *cacheConfig, pc *prefetchConfig, ready func()) error {
+	var (
+		layers = make([]*star.Reader, len(sfns))
+		// Caches of remote layers, nil for local ones.
+		caches = make([]*star.CachedReaderAt, len(sfns))
+		trace  *star.Trace
+	)
+	if len(record) > 0 {
+		trace = star.NewTrace()
+	}
+	for i, sfn := range sfns {
+		sr, cache, err := openStarCached(sfn, cc)
+		if err != nil {
+			return err
+		}
+		if trace != nil {
+			sr.SetTrace(trace)
+		}
+		layers[i], caches[i] = sr, cache
+	}
+	lr := star.NewLayeredReader(layers...)
+
+	if len(pidfile) > 0 {
+		if pid, err := readPidfile(pidfile); err == nil && processAlive(pid) {
+			return fmt.Errorf("pidfile %q held by running process %d", pidfile, pid)
+		}
+	}
+
+	server, err := star.NewMountServer(mntpoint, lr, opts)
+	if err != nil {
+		return fmt.Errorf("mounting %q at %q, %s", strings.Join(sfns, " "), mntpoint, err)
+	}
+
+	if len(pidfile) > 0 {
+		if err := writePidfile(pidfile, os.Getpid()); err != nil {
+			lazyUnmount(mntpoint)
+			return fmt.Errorf("writing pidfile, %s", err)
+		}
+		defer os.Remove(pidfile)
+	}
+
+	go unmountOnSignal(server, mntpoint)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i, sr := range layers {
+		if end, cache := sr.HotEnd(), caches[i]; cache != nil && end > 0 {
+			// Fetch the hot files in one request, before the workload asks
+			// for them one by one.
+			go func(sfn string) {
+				if err := cache.Preload(0, end); err != nil {
+					log.Printf("preloading hot files of %q, %s", sfn, err)
+				}
+			}(sfns[i])
+		}
+	}
+	if pc != nil {
+		if err := startPrefetch(ctx, lr, caches, pc); err != nil {
+			lazyUnmount(mntpoint)
+			return err
+		}
+	}
+
+	if ready != nil {
+		ready()
+	}
+	server.Wait()
+	for _, cache := range caches {
+		logCacheStats(cache)
+	}
+	if trace != nil {
+		if err := writeTrace(record, trace); err != nil {
+			return fmt.Errorf("writing trace, %s", err)
+		}
+	}
+	return nil
+}
+
+// writeTrace writes trace to name.
+func writeTrace(name string, trace *star.Trace) error {
+	return fs.WriteFileAtomic(name, 0644, func(w io.Writer) error {
+		_, err := trace.WriteTo(w)
+		return err
+	})
+}
+
+func unmountOnSignal(server *fuse.Server, mntpoint string) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigc
+	log.Printf("got %s, unmounting %q", sig, mntpoint)
+
+	if err := server.Unmount(); err != nil {
+		log.Printf("unmounting %q, %s, falling back to lazy unmount", mntpoint, err)
+		if err := lazyUnmount(mntpoint); err != nil {
+			log.Printf("lazy unmounting %q, %s", mntpoint, err)
+		}
+	}
+}
+
+// startDaemon re-executes the current command detached from the terminal,
+// and waits for the child to report the mount is being served.
+func startDaemon() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("getting executable, %s", err)
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("creating pipe, %s", err)
+	}
+	defer pr.Close()
+
+	devnull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("opening %s, %s", os.DevNull, err)
+	}
+	defer devnull.Close()
+
+	child := exec.Command(exe, os.Args[1:]...)
+	child.Env = append(os.Environ(), envDaemonChild+"=1")
+	child.Stdin = devnull
+	child.Stdout = devnull
+	child.Stderr = devnull
+	child.ExtraFiles = []*os.File{pw}
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := child.Start(); err != nil {
+		pw.Close()
+		return fmt.Errorf("starting daemon, %s", err)
+	}
+	pw.Close()
+
+	msg, err := ioutil.ReadAll(pr)
+	if err != nil {
+		return fmt.Errorf("reading daemon readiness, %s", err)
+	}
+	if string(msg) != "ok" {
+		child.Wait()
+		if len(msg) == 0 {
+			return fmt.Errorf("daemon exited before ready")
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return child.Process.Release()
+}
+
+// defaultPidfile returns the pidfile used when --pidfile is not given, so
+// mount and umount find the same file from the mountpoint alone.
+func defaultPidfile(mntpoint string) string {
+	if abs, err := filepath.Abs(mntpoint); err == nil {
+		mntpoint = abs
+	}
+	name := strings.ReplaceAll(strings.Trim(filepath.Clean(mntpoint), "/"), "/", "-")
+	return filepath.Join(os.TempDir(), "star-mount-"+name+".pid")
+}
+
+func readPidfile(pidfile string) (int, error) {
+	content, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing pidfile %q, %s", pidfile, err)
+	}
+	return pid, nil
+}
+
+func writePidfile(pidfile string, pid int) error {
+	return fs.WriteFileAtomic(pidfile, 0644, func(w io.Writer) error {
+		_, err := io.WriteString(w, strconv.Itoa(pid)+"\n")
+		return err
+	})
+}
+
+// processAlive reports whether pid is running, a process of another user,
+// which may not be signaled, included.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// lazyUnmount detaches mntpoint even if it is busy, or its server is gone.
+func lazyUnmount(mntpoint string) error {
+	out, err := exec.Command("fusermount", "-u", "-z", mntpoint).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if out2, err2 := exec.Command("umount", "-l", mntpoint).CombinedOutput(); err2 == nil {
+		return nil
+	} else {
+		out = append(out, out2...)
+	}
+	return fmt.Errorf("%s, %s", err, strings.TrimSpace(string(out)))
 }
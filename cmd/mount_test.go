@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestPidfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "star-pidfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pidfile := filepath.Join(dir, "star.pid")
+	if _, err := readPidfile(pidfile); !os.IsNotExist(err) {
+		t.Errorf("reading missing pidfile, want not exist, got %v", err)
+	}
+	for _, pid := range []int{1234, 42} {
+		if err := writePidfile(pidfile, pid); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readPidfile(pidfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != pid {
+			t.Errorf("pidfile read %d, want %d", got, pid)
+		}
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("pidfile written aside, %d files left in %q", len(infos), dir)
+	}
+
+	if err := ioutil.WriteFile(pidfile, []byte("not a pid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPidfile(pidfile); err == nil {
+		t.Errorf("reading garbled pidfile, want error")
+	}
+}
+
+func TestProcessAlive(t *testing.T) {
+	if !processAlive(os.Getpid()) {
+		t.Errorf("own process not alive")
+	}
+	// init may not be signaled by other users, but is alive all the same.
+	if !processAlive(1) {
+		t.Errorf("init not alive")
+	}
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("running true, %s", err)
+	}
+	if processAlive(cmd.Process.Pid) {
+		t.Errorf("reaped process %d alive", cmd.Process.Pid)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/star"
+)
+
+// cacheConfig configures the block cache under star files read over http(s).
+type cacheConfig struct {
+	blockSize int
+	memory    int64
+	dir       string
+}
+
+func addCacheFlags(cmd *cobra.Command) {
+	cmd.Flags().String("cache-block-size", humanize.IBytes(star.DefaultCacheBlockSize), "Size of blocks cached of remote star files")
+	cmd.Flags().String("cache-memory", humanize.IBytes(star.DefaultCacheMemory), "Memory for cached blocks of remote star files")
+	cmd.Flags().String("cache-dir", "", "Directory to cache blocks of remote star files on disk, holding up to whole files, never cleaned by star")
+}
+
+func getCacheFlags(cmd *cobra.Command) (*cacheConfig, error) {
+	flags := cmd.Flags()
+	blockSizeStr, err := flags.GetString("cache-block-size")
+	if err != nil {
+		return nil, fmt.Errorf("getting flag --cache-block-size, %w", err)
+	}
+	blockSize, err := humanize.ParseBytes(blockSizeStr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing flag --cache-block-size, %w", err)
+	}
+	memoryStr, err := flags.GetString("cache-memory")
+	if err != nil {
+		return nil, fmt.Errorf("getting flag --cache-memory, %w", err)
+	}
+	memory, err := humanize.ParseBytes(memoryStr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing flag --cache-memory, %w", err)
+	}
+	dir, err := flags.GetString("cache-dir")
+	if err != nil {
+		return nil, fmt.Errorf("getting flag --cache-dir, %w", err)
+	}
+	cc := &cacheConfig{
+		blockSize: int(blockSize),
+		memory:    int64(memory),
+		dir:       dir,
+	}
+	return cc, nil
+}
+
+// Credentials of registries, anonymous pulls if empty.
+const (
+	envRegistryUsername = "STAR_REGISTRY_USERNAME"
+	envRegistryPassword = "STAR_REGISTRY_PASSWORD"
+)
+
+// openStar opens the star file at name, which is a local path, an http(s)
+// URL read with Range requests, or a blob in a registry given as
+// registry/repository@digest.
+func openStar(name string) (*star.Reader, error) {
+	sr, _, err := openStarCached(name, nil)
+	return sr, err
+}
+
+// openStarCached is like openStar, remote star files are read through a block
+// cache configured by cc, if cc is not nil. The cache is returned for its
+// stats, nil if not used.
+func openStarCached(name string, cc *cacheConfig) (*star.Reader, *star.CachedReaderAt, error) {
+	hr, err := openRemote(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hr == nil {
+		sf, err := os.Open(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening star file %q, %w", name, err)
+		}
+		sr, err := star.NewReader(sf)
+		if err != nil {
+			sf.Close()
+			return nil, nil, fmt.Errorf("newing star reader, %w", err)
+		}
+		return sr, nil, nil
+	}
+
+	var (
+		ra    io.ReaderAt = hr
+		cache *star.CachedReaderAt
+	)
+	if cc != nil {
+		cache, err = star.NewCachedReaderAt(hr, hr.Size(), cc.blockSize, cc.memory)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(cc.dir) > 0 {
+			// Blocks of different files, or of the same file once changed,
+			// go to different directories.
+			key := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%s", name, hr.Size(), hr.ETag())))
+			if err := cache.SetDiskCache(filepath.Join(cc.dir, fmt.Sprintf("%x", key[:16]))); err != nil {
+				return nil, nil, err
+			}
+		}
+		ra = cache
+	}
+
+	sr, err := star.NewReaderSize(ra, hr.Size())
+	if err != nil {
+		return nil, nil, fmt.Errorf("newing star reader, %w", err)
+	}
+	return sr, cache, nil
+}
+
+// openRemote returns the reader of a remote star file, nil if name is a
+// local file.
+func openRemote(name string) (*star.HTTPReaderAt, error) {
+	if _, err := os.Lstat(name); err == nil {
+		return nil, nil
+	}
+	// URLs are plain files, even those parsing as registry refs, like
+	// "https://host/files/a.star@sha256:...".
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return star.NewHTTPReaderAt(name)
+	}
+	if _, err := star.ParseRegistryRef(name); err == nil {
+		return star.NewRegistryReaderAtAuth(name, os.Getenv(envRegistryUsername), os.Getenv(envRegistryPassword))
+	}
+	return nil, nil
+}
+
+// logCacheStats logs the stats of cache, if any.
+func logCacheStats(cache *star.CachedReaderAt) {
+	if cache == nil {
+		return
+	}
+	stats := cache.Stats()
+	log.Printf("cache: %d hits, %d disk hits, %d misses", stats.Hits, stats.DiskHits, stats.Misses)
+}
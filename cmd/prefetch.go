@@ -0,0 +1,209 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/fs"
+	"github.com/sequix/star/pkg/star"
+)
+
+// prefetchStatusInterval is how often the prefetch status file is written.
+const prefetchStatusInterval = time.Second
+
+// prefetchConfig configures prefetching of a remote star file.
+type prefetchConfig struct {
+	all        bool
+	files      []string
+	rate       int64
+	statusFile string
+}
+
+// getPrefetchFlags returns nil if nothing is to be prefetched.
+func getPrefetchFlags(cmd *cobra.Command) (*prefetchConfig, error) {
+	flags := cmd.Flags()
+	all, err := flags.GetBool("prefetch")
+	if err != nil {
+		return nil, fmt.Errorf("getting flag --prefetch, %w", err)
+	}
+	files, err := flags.GetStringSlice("prefetch-file")
+	if err != nil {
+		return nil, fmt.Errorf("getting flag --prefetch-file, %w", err)
+	}
+	rateStr, err := flags.GetString("prefetch-rate")
+	if err != nil {
+		return nil, fmt.Errorf("getting flag --prefetch-rate, %w", err)
+	}
+	rate, err := humanize.ParseBytes(rateStr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing flag --prefetch-rate, %w", err)
+	}
+	statusFile, err := flags.GetString("prefetch-status")
+	if err != nil {
+		return nil, fmt.Errorf("getting flag --prefetch-status, %w", err)
+	}
+	if !all && len(files) == 0 {
+		return nil, nil
+	}
+	pc := &prefetchConfig{
+		all:        all,
+		files:      files,
+		rate:       int64(rate),
+		statusFile: statusFile,
+	}
+	return pc, nil
+}
+
+// defaultCacheDir returns the cache dir used if prefetching without one.
+func defaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("getting user cache dir, %w", err)
+	}
+	return filepath.Join(dir, "star"), nil
+}
+
+// startPrefetch prefetches the remote layers of lr in background until done
+// or ctx is done, writing the progress of all layers to the status file if
+// configured. caches are those of the layers, nil for local layers.
+func startPrefetch(ctx context.Context, lr *star.LayeredReader, caches []*star.CachedReaderAt, pc *prefetchConfig) error {
+	var (
+		layers      = lr.Layers()
+		prefetchers = map[*star.Reader]*star.Prefetcher{}
+		ps          []*star.Prefetcher
+	)
+	for i, sr := range layers {
+		if caches[i] == nil {
+			continue
+		}
+		p := star.NewPrefetcher(caches[i])
+		p.SetAll(pc.all)
+		// Each layer is limited on its own, as they are fetched apart.
+		p.SetRate(pc.rate)
+		if end := sr.HotEnd(); end > 0 {
+			p.Prioritize(0, end)
+		}
+		prefetchers[sr] = p
+		ps = append(ps, p)
+	}
+	if len(ps) == 0 {
+		log.Printf("all star files are local, nothing to prefetch")
+		return nil
+	}
+
+	for _, name := range pc.files {
+		sr, err := lr.LayerOf(name)
+		if err != nil {
+			return fmt.Errorf("prefetching %q, %w", name, err)
+		}
+		p, ok := prefetchers[sr]
+		if !ok {
+			continue
+		}
+		off, length, err := sr.StoredRange(name)
+		if err != nil {
+			return fmt.Errorf("prefetching %q, %w", name, err)
+		}
+		p.Prioritize(off, length)
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range ps {
+		wg.Add(1)
+		go func(p *star.Prefetcher) {
+			defer wg.Done()
+			if err := p.Run(ctx); err != nil && err != context.Canceled {
+				log.Printf("prefetching, %s", err)
+			}
+		}(p)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if len(pc.statusFile) > 0 {
+		go func() {
+			ticker := time.NewTicker(prefetchStatusInterval)
+			defer ticker.Stop()
+			for {
+				if err := writePrefetchStatus(pc.statusFile, prefetchStatus(ps)); err != nil {
+					log.Printf("writing prefetch status, %s", err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-done:
+					if err := writePrefetchStatus(pc.statusFile, prefetchStatus(ps)); err != nil {
+						log.Printf("writing prefetch status, %s", err)
+					}
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// prefetchStatus sums up the progress of ps.
+func prefetchStatus(ps []*star.Prefetcher) star.PrefetchStatus {
+	sum := star.PrefetchStatus{Done: true}
+	for _, p := range ps {
+		status := p.Status()
+		sum.Blocks += status.Blocks
+		sum.Bytes += status.Bytes
+		sum.DoneBlocks += status.DoneBlocks
+		sum.DoneBytes += status.DoneBytes
+		sum.FetchedBytes += status.FetchedBytes
+		sum.Done = sum.Done && status.Done
+		if len(sum.Err) == 0 {
+			sum.Err = status.Err
+		}
+	}
+	return sum
+}
+
+// writePrefetchStatus writes status as JSON.
+func writePrefetchStatus(name string, status star.PrefetchStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileAtomic(name, 0644, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/star"
+)
+
+// repackCmd represents the repack command
+var repackCmd = &cobra.Command{
+	Use:   "repack --order <profile.json> <old.star> <new.star>",
+	Short: "Rewrite a star file placing hot files first.",
+	Long: `Rewrite a star file placing the files of an access profile first.
+
+The profile is a trace recorded by "star mount --record". Files are placed in
+the order they were first touched, and the star file marks where they end,
+so a lazy reader could fetch all of them in one request at startup. Other
+files keep their order.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		repackRun(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(repackCmd)
+	repackCmd.Flags().BoolP("force", "f", false, "Overwrite existing file")
+	repackCmd.Flags().String("order", "", "Access profile recorded by star mount --record")
+}
+
+func repackRun(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Help()
+		return
+	}
+
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		log.Fatalf("getting flag --force, %s", err)
+	}
+	order, err := cmd.Flags().GetString("order")
+	if err != nil {
+		log.Fatalf("getting flag --order, %s", err)
+	}
+	if len(order) == 0 {
+		log.Fatal("--order is required")
+	}
+	hot, err := readProfile(order)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = rewriteStar(args[0], args[1], force, func(w io.Writer, sr *star.Reader) error {
+		return star.Repack(w, sr, hot)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readProfile returns the names of the files in the access profile, in the
+// order they were first touched.
+func readProfile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("opening profile %q, %w", name, err)
+	}
+	defer f.Close()
+
+	files, err := star.ReadTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading profile %q, %w", name, err)
+	}
+	names := make([]string, 0, len(files))
+	for _, tf := range files {
+		names = append(names, tf.Name)
+	}
+	return names, nil
+}
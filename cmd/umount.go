@@ -0,0 +1,110 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// umountCmd represents the umount command
+var umountCmd = &cobra.Command{
+	Use:   "umount <mountpoint>",
+	Short: "Unmount a star file mounted by star mount --daemon.",
+	Long: `Unmount a star file mounted by star mount --daemon.
+
+The daemon found in the pidfile is asked to unmount with SIGTERM. If there is
+no daemon, or it does not exit in time, the mountpoint is lazily unmounted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		umountRun(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(umountCmd)
+	umountCmd.Flags().StringP("pidfile", "p", "", "Pidfile of the daemon, default derived from mountpoint.")
+	umountCmd.Flags().DurationP("timeout", "t", 10*time.Second, "Time to wait for the daemon to exit.")
+}
+
+func umountRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Help()
+		return
+	}
+	mntpoint := args[0]
+
+	flags := cmd.Flags()
+	pidfile, err := flags.GetString("pidfile")
+	if err != nil {
+		log.Fatalf("getting flag --pidfile, %s", err)
+	}
+	if len(pidfile) == 0 {
+		pidfile = defaultPidfile(mntpoint)
+	}
+	timeout, err := flags.GetDuration("timeout")
+	if err != nil {
+		log.Fatalf("getting flag --timeout, %s", err)
+	}
+
+	pid, err := readPidfile(pidfile)
+	if err == nil && processAlive(pid) {
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			log.Printf("signaling daemon %d, %s", pid, err)
+		}
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+			if !processAlive(pid) {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		log.Printf("daemon %d not exited in %s", pid, timeout)
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Printf("reading pidfile, %s", err)
+	}
+
+	if !mounted(mntpoint) {
+		os.Remove(pidfile)
+		return
+	}
+	if err := lazyUnmount(mntpoint); err != nil {
+		log.Fatalf("lazy unmounting %q, %s", mntpoint, err)
+	}
+	os.Remove(pidfile)
+}
+
+// mounted reports whether mntpoint is still a mountpoint, a mount whose server
+// is gone counts as mounted.
+func mounted(mntpoint string) bool {
+	var st, pst syscall.Stat_t
+	if err := syscall.Stat(mntpoint, &st); err != nil {
+		return err == syscall.ENOTCONN
+	}
+	if err := syscall.Stat(filepath.Dir(filepath.Clean(mntpoint)), &pst); err != nil {
+		return true
+	}
+	return st.Dev != pst.Dev
+}
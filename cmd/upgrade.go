@@ -0,0 +1,111 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/star"
+)
+
+// upgradeCmd represents the upgrade command
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade <old.star> <new.star>",
+	Short: "Rewrite a star file in the latest format version.",
+	Long: `Rewrite a star file written by an older star in the latest format version.
+
+Files keep their compression and digest algorithm, files without a digest
+get one. The new star file is written aside and renamed into place, so
+old.star and new.star could be the same file with --force.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		upgradeRun(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(upgradeCmd)
+	upgradeCmd.Flags().BoolP("force", "f", false, "Overwrite existing file")
+}
+
+func upgradeRun(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Help()
+		return
+	}
+
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		log.Fatalf("getting flag --force, %s", err)
+	}
+	if err := rewriteStar(args[0], args[1], force, star.Upgrade); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// rewriteStar rewrites the star file oldName to newName with rewrite. The new
+// star file is written aside and renamed into place, so both names could be
+// the same file.
+func rewriteStar(oldName, newName string, force bool, rewrite func(io.Writer, *star.Reader) error) error {
+	if _, err := os.Lstat(newName); err == nil && !force {
+		return fmt.Errorf("star file %q exists, use --force to overwrite it", newName)
+	}
+
+	of, err := os.Open(oldName)
+	if err != nil {
+		return fmt.Errorf("opening star file %q, %s", oldName, err)
+	}
+	defer of.Close()
+
+	sr, err := star.NewReader(of)
+	if err != nil {
+		return fmt.Errorf("newing star reader, %s", err)
+	}
+
+	nf, err := ioutil.TempFile(filepath.Dir(newName), ".star-rewrite-")
+	if err != nil {
+		return fmt.Errorf("creating temporary file for %q, %s", newName, err)
+	}
+	if err := rewrite(nf, sr); err != nil {
+		nf.Close()
+		os.Remove(nf.Name())
+		return fmt.Errorf("rewriting star file %q, %s", oldName, err)
+	}
+	if err := nf.Close(); err != nil {
+		os.Remove(nf.Name())
+		return fmt.Errorf("closing star file %q, %s", nf.Name(), err)
+	}
+	if err := os.Chmod(nf.Name(), 0644); err != nil {
+		log.Printf("changing mode of %q, %s", nf.Name(), err)
+	}
+	if err := os.Rename(nf.Name(), newName); err != nil {
+		os.Remove(nf.Name())
+		return fmt.Errorf("renaming %q to %q, %s", nf.Name(), newName, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2020 sequix <sequix@163.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sequix/star/pkg/fs"
+	"github.com/sequix/star/pkg/star"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify <xxx.star|url>",
+	Short: "Verify content of a star file against its digests.",
+	Long: `Verify content of a star file against its digests.
+
+Every regular file is read and hashed, mismatched files are reported, and
+the exit status is non-zero if there is any.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		verifyRun(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().BoolP("verbose", "v", false, "Print every file verified")
+}
+
+func verifyRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Help()
+		return
+	}
+
+	verbose, err := cmd.Flags().GetBool("verbose")
+	if err != nil {
+		fmt.Printf("getting flag `verbose`: %s\n", err)
+		os.Exit(1)
+	}
+
+	sr, err := openStar(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var verified, mismatched, skipped int
+	for _, fi := range sr.ListFiles() {
+		// Hard links share the payload verified with their target.
+		if !fi.Mode.IsRegular() || fi.Kind == fs.KindHardlink {
+			continue
+		}
+
+		vr, err := sr.VerifiedReaderForInfo(fi)
+		if errors.Is(err, star.ErrNoDigest) {
+			skipped++
+			continue
+		}
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, vr)
+		}
+		if err != nil {
+			mismatched++
+			fmt.Printf("FAIL %s: %s\n", fi.Name, err)
+			continue
+		}
+
+		verified++
+		if verbose {
+			fmt.Printf("OK   %s %s\n", fi.Name, fi.Digest)
+		}
+	}
+
+	fmt.Printf("%d verified, %d failed, %d without digest\n", verified, mismatched, skipped)
+	if mismatched > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,10 +1,16 @@
 module github.com/sequix/star
 
-go 1.13
+go 1.17
 
 require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/hanwen/go-fuse/v2 v2.0.2
+	github.com/klauspost/compress v1.11.13
 	github.com/spf13/cobra v0.0.6
 	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a
 )
+
+require (
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+)
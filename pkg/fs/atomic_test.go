@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "star-atomic-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "f")
+	write := func(content string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		}
+	}
+	if err := WriteFileAtomic(name, 0640, write("old")); err != nil {
+		t.Fatal(err)
+	}
+	errFailed := errors.New("failed")
+	err = WriteFileAtomic(name, 0640, func(w io.Writer) error {
+		io.WriteString(w, "part of new")
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("failed write, want %v, got %v", errFailed, err)
+	}
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "old" {
+		t.Errorf("after a failed write, want %q, got %q", "old", content)
+	}
+	st, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0640 {
+		t.Errorf("mode, want %v, got %v", os.FileMode(0640), st.Mode().Perm())
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("temporary files left, %d files in %q", len(infos), dir)
+	}
+}
@@ -0,0 +1,157 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// DefaultOverflowID is the id of ids mapped by no range, unless the kernel
+// says otherwise, see OverflowUID.
+const DefaultOverflowID = 65534
+
+// IDMap maps the uids or gids of files in archives, as seen in a container,
+// to those on the host, like /proc/self/uid_map does for a user namespace.
+// Ids mapped by no range are mapped to Overflow. A nil IDMap maps ids to
+// themselves.
+type IDMap struct {
+	Ranges   []IDRange
+	Overflow uint32
+}
+
+// IDRange maps Count ids from Inside to Outside, a line of /proc/self/uid_map.
+type IDRange struct {
+	Inside, Outside, Count uint32
+}
+
+// ParseIDMap parses lines of "<inside> <outside> <count>", the format of
+// /proc/self/uid_map, with ids mapped by no line mapped to overflow.
+func ParseIDMap(spec string, overflow uint32) (*IDMap, error) {
+	m := &IDMap{Overflow: overflow}
+	sc := bufio.NewScanner(strings.NewReader(spec))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("parsing id map line %q, want <inside> <outside> <count>", sc.Text())
+		}
+		var ids [3]uint32
+		for i, field := range fields {
+			id, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("parsing id map line %q, %w", sc.Text(), err)
+			}
+			ids[i] = uint32(id)
+		}
+		r := IDRange{Inside: ids[0], Outside: ids[1], Count: ids[2]}
+		if r.Count == 0 || uint64(r.Inside)+uint64(r.Count) > 1<<32 || uint64(r.Outside)+uint64(r.Count) > 1<<32 {
+			return nil, fmt.Errorf("invalid id map line %q", sc.Text())
+		}
+		for _, o := range m.Ranges {
+			if overlaps(r.Inside, o.Inside, r.Count, o.Count) || overlaps(r.Outside, o.Outside, r.Count, o.Count) {
+				return nil, fmt.Errorf("id map line %q overlaps %d %d %d", sc.Text(), o.Inside, o.Outside, o.Count)
+			}
+		}
+		m.Ranges = append(m.Ranges, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading id map, %w", err)
+	}
+	if len(m.Ranges) == 0 {
+		return nil, fmt.Errorf("empty id map")
+	}
+	return m, nil
+}
+
+func overlaps(a, b, alen, blen uint32) bool {
+	return uint64(a) < uint64(b)+uint64(blen) && uint64(b) < uint64(a)+uint64(alen)
+}
+
+// Map returns the id on the host of the id in the container.
+func (m *IDMap) Map(id uint32) uint32 {
+	if m == nil {
+		return id
+	}
+	for _, r := range m.Ranges {
+		if id >= r.Inside && id-r.Inside < r.Count {
+			return r.Outside + (id - r.Inside)
+		}
+	}
+	return m.Overflow
+}
+
+// Unmap returns the id in the container of the id on the host, the reverse
+// of Map.
+func (m *IDMap) Unmap(id uint32) uint32 {
+	if m == nil {
+		return id
+	}
+	for _, r := range m.Ranges {
+		if id >= r.Outside && id-r.Outside < r.Count {
+			return r.Inside + (id - r.Outside)
+		}
+	}
+	return m.Overflow
+}
+
+// OverflowUID returns the uid the kernel shows for uids not mapped in a user
+// namespace.
+func OverflowUID() uint32 {
+	return overflowID("/proc/sys/kernel/overflowuid")
+}
+
+// OverflowGID is like OverflowUID for gids.
+func OverflowGID() uint32 {
+	return overflowID("/proc/sys/kernel/overflowgid")
+}
+
+func overflowID(name string) uint32 {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return DefaultOverflowID
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 32)
+	if err != nil {
+		return DefaultOverflowID
+	}
+	return uint32(id)
+}
+
+// MapIDs returns a copy of fi with its ids mapped to the host, or fi itself
+// if both maps are nil.
+func MapIDs(fi *FileInfo, uids, gids *IDMap) *FileInfo {
+	if uids == nil && gids == nil {
+		return fi
+	}
+	mapped := *fi
+	mapped.Uid, mapped.Gid = uids.Map(fi.Uid), gids.Map(fi.Gid)
+	return &mapped
+}
+
+// UnmapIDs returns a Reader of the files of r with their ids on the host
+// mapped back to those in the container, the reverse of MapIDs, e.g. to
+// archive a rootfs written by a container.
+func UnmapIDs(r Reader, uids, gids *IDMap) Reader {
+	if uids == nil && gids == nil {
+		return r
+	}
+	return &unmapReader{r: r, uids: uids, gids: gids}
+}
+
+type unmapReader struct {
+	r          Reader
+	uids, gids *IDMap
+}
+
+func (r *unmapReader) Next() (*File, error) {
+	f, err := r.r.Next()
+	if err != nil {
+		return nil, err
+	}
+	f.Uid, f.Gid = r.uids.Unmap(f.Uid), r.gids.Unmap(f.Gid)
+	return f, nil
+}
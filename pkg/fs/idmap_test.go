@@ -0,0 +1,49 @@
+package fs
+
+import (
+	"testing"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := ParseIDMap("0 1000 1\n\n1 100000 65536\n", 65534)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ inside, outside uint32 }{
+		{0, 1000},
+		{1, 100000},
+		{65536, 165535},
+		{65537, 65534},
+	} {
+		if got := m.Map(c.inside); got != c.outside {
+			t.Errorf("map %d, want %d, got %d", c.inside, c.outside, got)
+		}
+	}
+	if got := m.Unmap(100000); got != 1 {
+		t.Errorf("unmap 100000, want 1, got %d", got)
+	}
+	if got := m.Unmap(1); got != 65534 {
+		t.Errorf("unmap 1, want 65534, got %d", got)
+	}
+}
+
+func TestParseIDMapCorrupted(t *testing.T) {
+	for name, spec := range map[string]string{
+		"empty":            "",
+		"blank":            "\n \n",
+		"short":            "0 1000",
+		"long":             "0 1000 1 1",
+		"letters":          "0 root 1",
+		"negative":         "0 -1 1",
+		"too big":          "0 4294967296 1",
+		"zero count":       "0 1000 0",
+		"inside overflow":  "4294967295 0 2",
+		"outside overflow": "0 4294967295 2",
+		"inside overlap":   "0 1000 10\n5 2000 10",
+		"outside overlap":  "0 1000 10\n100 1005 10",
+	} {
+		if _, err := ParseIDMap(spec, 65534); err == nil {
+			t.Errorf("%s, want an error", name)
+		}
+	}
+}
@@ -9,6 +9,9 @@ import (
 // FilesystemReader is an interface for source filesystem to be used during
 // tar operations. Next() is expected to return files and directories in a
 // consistent and stable order and return io.EOF when no further files are available.
+//
+// The Data of a File must be read before calling Next() again, as it may be
+// streamed from the same source as the following files, see TarReader.
 type Reader interface {
 	Next() (*File, error)
 }
@@ -19,13 +22,32 @@ type Reader interface {
 type File struct {
 	FileInfo
 
-	// File content. Nil for non-regular files.
+	// File content. Nil for non-regular files and hard links. Valid until
+	// the next call of Reader.Next().
 	Data io.ReadCloser
 }
 
+// Kind tells apart entries which could not be told apart by os.FileMode.
+type Kind uint8
+
+const (
+	// KindNormal entries are what their Mode says.
+	KindNormal Kind = iota
+	// KindHardlink entries are hard links to the regular file named by
+	// Linkname, sharing its content and Size.
+	KindHardlink
+	// KindWhiteout entries delete the file Name of lower layers, see
+	// ParseWhiteout.
+	KindWhiteout
+	// KindOpaque entries hide all entries of lower layers in the directory
+	// Name, see ParseWhiteout.
+	KindOpaque
+)
+
 type FileInfo struct {
 	Name string
 	Size uint64
+	Kind Kind
 
 	Uid uint32
 	Gid uint32
@@ -39,7 +61,7 @@ type FileInfo struct {
 	Mode os.FileMode
 	Xattrs map[string]string
 
-	// Link target for symlinks
+	// Link target for symlinks and hard links
 	Linkname string
 
 	// Major/Minor for character or block devices
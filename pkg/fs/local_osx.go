@@ -14,13 +14,21 @@ import (
 
 type LocalReader struct {
 	fis []os.FileInfo
+	// First name seen of regular files having multiple links.
+	links map[fileID]string
+}
+
+type fileID struct {
+	dev uint64
+	ino uint64
 }
 
 func NewLocalReader(files ...string) (Reader, error) {
 	var (
 		dedup = map[string]struct{}{}
 		lr    = &LocalReader{
-			fis: make([]os.FileInfo, 0, len(files)),
+			fis:   make([]os.FileInfo, 0, len(files)),
+			links: map[fileID]string{},
 		}
 	)
 
@@ -33,7 +41,10 @@ func NewLocalReader(files ...string) (Reader, error) {
 		if err != nil {
 			return nil, fmt.Errorf("lstat file %q, %w", f, err)
 		}
-		lr.fis = append(lr.fis, fi)
+		lr.fis = append(lr.fis, &fullPathFileInfo{
+			FileInfo: fi,
+			prefix:   filepath.Dir(f),
+		})
 	}
 	return lr, nil
 }
@@ -50,9 +61,28 @@ func (r *LocalReader) Next() (*File, error) {
 	)
 	r.fis = r.fis[1:]
 
-	mode := fi.Mode()
-	size := uint64(0)
-	if mode.IsRegular() {
+	fsi, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fsi == nil {
+		return nil, fmt.Errorf("getting Stat_t")
+	}
+
+	var (
+		kind     = KindNormal
+		linkname string
+		mode     = fi.Mode()
+		size     = uint64(0)
+	)
+	if mode.IsRegular() && fsi.Nlink > 1 {
+		id := fileID{dev: uint64(fsi.Dev), ino: uint64(fsi.Ino)}
+		if first, ok := r.links[id]; ok {
+			kind, linkname = KindHardlink, first
+		} else {
+			r.links[id] = name
+		}
+	}
+
+	// Content of hard links is read once, with the first name.
+	if mode.IsRegular() && kind == KindNormal {
 		data, err = os.Open(name)
 		if err != nil {
 			return nil, fmt.Errorf("opening file %q, %w", name, err)
@@ -71,30 +101,30 @@ func (r *LocalReader) Next() (*File, error) {
 		}
 	}
 
-	var linkname string
 	if (fi.Mode() & os.ModeType) == os.ModeSymlink {
 		linkname, err = os.Readlink(name)
 		if err != nil {
-			return nil, fmt.Errorf("reading link %q")
+			return nil, fmt.Errorf("reading link %q, %w", name, err)
 		}
 	}
 
-	fsi, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok || fsi == nil {
-		return nil, fmt.Errorf("getting Stat_t")
+	xattrs, err := lgetxattrs(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading xattrs, %w", err)
 	}
 
 	fh := &File{
 		FileInfo: FileInfo{
 			Name:     name,
 			Size:     size,
+			Kind:     kind,
 			Uid:      fsi.Uid,
 			Gid:      fsi.Gid,
 			Mtime:    time.Unix(fsi.Mtimespec.Sec, fsi.Mtimespec.Nsec),
 			Atime:    time.Unix(fsi.Atimespec.Sec, fsi.Atimespec.Nsec),
 			Ctime:    time.Unix(fsi.Ctimespec.Sec, fsi.Ctimespec.Nsec),
 			Mode:     fi.Mode(),
-			Xattrs:   map[string]string{},
+			Xattrs:   xattrs,
 			Linkname: linkname,
 			Major:    uint32(fsi.Rdev) >> 8,
 			Minor:    uint32(fsi.Rdev & 0xFF),
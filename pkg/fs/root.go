@@ -0,0 +1,218 @@
+// +build linux
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Root is a directory files of archives are written beneath. Names are
+// resolved beneath it, with openat2 RESOLVE_BENEATH where the kernel has it,
+// so names and symlinks escaping it, e.g. "../etc/passwd" or a file written
+// through a symlink to "/etc", are rejected. Symlinks are still created as
+// archived, pointing anywhere, it is following them out of the root that is
+// rejected.
+type Root struct {
+	dir string
+	fd  int
+}
+
+// OpenRoot returns the Root of the directory dir.
+func OpenRoot(dir string) (*Root, error) {
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening root %q, %w", dir, err)
+	}
+	return &Root{dir: dir, fd: fd}, nil
+}
+
+func (r *Root) Close() error {
+	return unix.Close(r.fd)
+}
+
+// Resolve returns a path to the file name beneath r, which does not follow
+// symlinks in the directories of name out of r, and parent, the directory
+// holding the file, which must be closed once done with the path. The file
+// itself is not resolved, so it could be created, or a symlink.
+func (r *Root) Resolve(name string) (p string, parent *os.File, err error) {
+	name, err = r.clean(name)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, base := path.Split(name)
+	if len(base) == 0 {
+		base = "."
+	}
+	fd, err := r.openDir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	parent = os.NewFile(uintptr(fd), filepath.Join(r.dir, dir))
+	return fmt.Sprintf("/proc/self/fd/%d/%s", fd, base), parent, nil
+}
+
+// MkdirAll creates the directory dir beneath r with perm, and its parents.
+func (r *Root) MkdirAll(dir string, perm os.FileMode) error {
+	dir, err := r.clean(dir)
+	if err != nil {
+		return err
+	}
+	if dir == "." {
+		return nil
+	}
+
+	parent := r.fd
+	defer func() {
+		if parent != r.fd {
+			unix.Close(parent)
+		}
+	}()
+	comps := strings.Split(dir, "/")
+	for i, comp := range comps {
+		fd, err := r.openDir(strings.Join(comps[:i+1], "/"))
+		if errors.Is(err, unix.ENOENT) {
+			err = unix.Mkdirat(parent, comp, uint32(perm.Perm()))
+			if err != nil && err != unix.EEXIST {
+				return fmt.Errorf("mkdir %q, %w", filepath.Join(r.dir, strings.Join(comps[:i+1], "/")), err)
+			}
+			fd, err = r.openDir(strings.Join(comps[:i+1], "/"))
+		}
+		if err != nil {
+			return err
+		}
+		if parent != r.fd {
+			unix.Close(parent)
+		}
+		parent = fd
+	}
+	return nil
+}
+
+// clean returns name relative to r, rejecting absolute names and names
+// climbing out of r.
+func (r *Root) clean(name string) (string, error) {
+	name = path.Clean(filepath.ToSlash(name))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("unsafe path %q, outside of %q", name, r.dir)
+	}
+	return name, nil
+}
+
+// openDir opens the directory dir beneath r as an O_PATH fd.
+func (r *Root) openDir(dir string) (int, error) {
+	if len(dir) == 0 {
+		dir = "."
+	}
+	fd, err := openat2(r.fd, dir, &openHow{
+		flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		resolve: resolveBeneath | resolveNoMagiclinks,
+	})
+	if err == unix.ENOSYS || err == unix.EPERM {
+		// No openat2 in the kernel, or forbidden by seccomp.
+		fd, err = r.openDirSlow(dir)
+	}
+	switch err {
+	case nil:
+		return fd, nil
+	case unix.EXDEV, unix.ELOOP:
+		return -1, fmt.Errorf("unsafe path %q, resolving out of %q", dir, r.dir)
+	}
+	return -1, fmt.Errorf("opening %q beneath %q, %w", dir, r.dir, err)
+}
+
+// openDirSlow is openDir resolving symlinks in user space, for kernels
+// without openat2.
+func (r *Root) openDirSlow(dir string) (int, error) {
+	var (
+		resolved []string
+		todo     = strings.Split(dir, "/")
+		links    int
+	)
+	for len(todo) > 0 {
+		comp := todo[0]
+		todo = todo[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return -1, unix.EXDEV
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		p := strings.Join(append(resolved, comp), "/")
+		var st unix.Stat_t
+		if err := unix.Fstatat(r.fd, p, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return -1, err
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFLNK {
+			resolved = append(resolved, comp)
+			continue
+		}
+
+		if links++; links > 40 {
+			return -1, unix.ELOOP
+		}
+		buf := make([]byte, unix.PathMax)
+		n, err := unix.Readlinkat(r.fd, p, buf)
+		if err != nil {
+			return -1, err
+		}
+		target := string(buf[:n])
+		if path.IsAbs(target) {
+			return -1, unix.EXDEV
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+
+	p := strings.Join(resolved, "/")
+	if len(p) == 0 {
+		p = "."
+	}
+	return unix.Openat(r.fd, p, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// openat2 is not in the golang.org/x/sys we use, its number is the same on
+// all architectures but alpha.
+const sysOpenat2 = 437
+
+const (
+	resolveNoMagiclinks = 0x02
+	resolveBeneath      = 0x08
+)
+
+// openHow is struct open_how of openat2.
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+func openat2(dirfd int, p string, how *openHow) (int, error) {
+	bp, err := unix.BytePtrFromString(p)
+	if err != nil {
+		return -1, err
+	}
+	for {
+		fd, _, errno := unix.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(bp)),
+			uintptr(unsafe.Pointer(how)), unsafe.Sizeof(*how), 0, 0)
+		// Retried as the kernel asks, on renames racing the resolution.
+		if errno == unix.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			return -1, errno
+		}
+		return int(fd), nil
+	}
+}
@@ -0,0 +1,174 @@
+// +build linux
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestRoot returns a Root with a directory sub, symlinks in and out of it,
+// and a symlink loop.
+func newTestRoot(t *testing.T) (*Root, string) {
+	t.Helper()
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"in":      "sub",
+		"subin":   "../sub",
+		"abs":     outside,
+		"absroot": "/",
+		"up":      "../..",
+		"subup":   "sub/../..",
+		"loop1":   "loop2",
+		"loop2":   "loop1",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../..", filepath.Join(dir, "sub", "up")); err != nil {
+		t.Fatal(err)
+	}
+	root, err := OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	return root, outside
+}
+
+var rootResolveTests = []struct {
+	name string
+	ok   bool
+}{
+	{"f", true},
+	{"sub/f", true},
+	{"./sub/../f", true},
+	{"in/f", true},
+	{"sub/../in/f", true},
+	// Names climbing out, or absolute.
+	{"../f", false},
+	{"sub/../../f", false},
+	{"/etc/passwd", false},
+	// Symlinks resolving out.
+	{"abs/f", false},
+	{"absroot/etc/passwd", false},
+	{"up/f", false},
+	{"subin/f", false},
+	{"subup/f", false},
+	{"sub/up/f", false},
+	{"loop1/f", false},
+}
+
+func TestRootResolve(t *testing.T) {
+	root, _ := newTestRoot(t)
+	for _, tc := range rootResolveTests {
+		p, parent, err := root.Resolve(tc.name)
+		if err == nil {
+			parent.Close()
+		}
+		if tc.ok && err != nil {
+			t.Errorf("resolving %q, %v", tc.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("resolving %q, want error, got %q", tc.name, p)
+		}
+	}
+}
+
+// TestRootResolveSlow checks the resolution of kernels without openat2.
+func TestRootResolveSlow(t *testing.T) {
+	root, _ := newTestRoot(t)
+	for _, tc := range rootResolveTests {
+		name, err := root.clean(tc.name)
+		if err != nil {
+			if tc.ok {
+				t.Errorf("cleaning %q, %v", tc.name, err)
+			}
+			continue
+		}
+		dir, _ := filepath.Split(name)
+		fd, err := root.openDirSlow(filepath.Clean("./" + dir))
+		if err == nil {
+			os.NewFile(uintptr(fd), dir).Close()
+		}
+		if tc.ok && err != nil {
+			t.Errorf("resolving %q, %v", tc.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("resolving %q, want error", tc.name)
+		}
+	}
+}
+
+func TestRootWrite(t *testing.T) {
+	root, outside := newTestRoot(t)
+
+	if err := root.MkdirAll("sub/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(filepath.Join(root.dir, "sub/a/b")); err != nil || !st.IsDir() {
+		t.Errorf("want sub/a/b created, got %v", err)
+	}
+	for _, dir := range []string{"abs/a", "up/a", "../a", "loop1/a"} {
+		if err := root.MkdirAll(dir, 0755); err == nil {
+			t.Errorf("mkdir %q, want error", dir)
+		}
+	}
+	if des, _ := os.ReadDir(outside); len(des) > 0 {
+		t.Errorf("want nothing written out of the root, got %d entries", len(des))
+	}
+
+	// Written through the path resolved, the file is beneath the root.
+	p, parent, err := root.Resolve("in/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root.dir, "sub/f")); err != nil {
+		t.Errorf("want sub/f written, got %v", err)
+	}
+}
+
+func TestRootWriteDirOverSymlink(t *testing.T) {
+	root, outside := newTestRoot(t)
+	if err := os.Chmod(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory archived after a symlink of the same name replaces it.
+	p, parent, err := root.Resolve("abs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	fi := &FileInfo{Name: p, Mode: os.ModeDir | 0500}
+	opts := &WriteOptions{Rootless: true}
+	if err := MkdirAll(fi, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreDirMode(fi, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(t, filepath.Join(root.dir, "abs"), os.ModeDir|0500)
+	checkMode(t, outside, os.ModeDir|0755)
+	os.Chmod(filepath.Join(root.dir, "abs"), 0755)
+
+	// Nor is a symlink swapped in followed once the directory is written.
+	if err := os.Remove(filepath.Join(root.dir, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root.dir, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreDirMode(fi, opts); err == nil {
+		t.Error("restoring the mode through a symlink, want error")
+	}
+	checkMode(t, outside, os.ModeDir|0755)
+}
@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// RootlessXattr records the ownership a file extracted without privileges
+// should have had, as a Resource message of the rootless containers
+// protobuf, github.com/rootless-containers/proto, which umoci and runc read.
+// Device nodes, extracted as empty regular files, also record their type and
+// device number in fields the upstream message leaves unused.
+const RootlessXattr = "user.rootlesscontainers"
+
+// Fields of the Resource message, the uid and gid being upstream ones.
+const (
+	rootlessUID    = 1
+	rootlessGID    = 2
+	rootlessDevice = 100
+	rootlessMajor  = 101
+	rootlessMinor  = 102
+)
+
+// Device types recorded by rootlessDevice, the S_IFMT bits of the device.
+const (
+	rootlessCharDevice  = 0020000
+	rootlessBlockDevice = 0060000
+)
+
+// rootlessResource returns the value of RootlessXattr for fi, nil if fi is
+// owned by root and is not a device, which needs nothing recorded.
+func rootlessResource(fi *FileInfo) []byte {
+	var b []byte
+	// Zero values are left out, as protobuf does.
+	field := func(num, value uint32) {
+		if value == 0 {
+			return
+		}
+		b = appendUvarint(b, uint64(num)<<3)
+		b = appendUvarint(b, uint64(value))
+	}
+	field(rootlessUID, fi.Uid)
+	field(rootlessGID, fi.Gid)
+	switch fi.Mode & os.ModeType {
+	case os.ModeDevice | os.ModeCharDevice:
+		field(rootlessDevice, rootlessCharDevice)
+	case os.ModeDevice:
+		field(rootlessDevice, rootlessBlockDevice)
+	}
+	field(rootlessMajor, fi.Major)
+	field(rootlessMinor, fi.Minor)
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// restoreRootless sets the ownership and device recorded in value on fi,
+// skipping fields it does not know.
+func restoreRootless(fi *FileInfo, value []byte) error {
+	var fields [rootlessMinor + 1]uint32
+	for len(value) > 0 {
+		tag, n := binary.Uvarint(value)
+		if n <= 0 {
+			return fmt.Errorf("parsing field tag")
+		}
+		value = value[n:]
+
+		num, size := tag>>3, 0
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(value)
+			if n <= 0 {
+				return fmt.Errorf("parsing field %d", num)
+			}
+			if num < uint64(len(fields)) {
+				fields[num] = uint32(v)
+			}
+			size = n
+		case 1:
+			size = 8
+		case 2:
+			l, n := binary.Uvarint(value)
+			if n <= 0 || l > uint64(len(value)-n) {
+				return fmt.Errorf("parsing field %d", num)
+			}
+			size = n + int(l)
+		case 5:
+			size = 4
+		default:
+			return fmt.Errorf("unknown wire type of field %d", num)
+		}
+		if size > len(value) {
+			return fmt.Errorf("parsing field %d, truncated", num)
+		}
+		value = value[size:]
+	}
+
+	fi.Uid, fi.Gid = fields[rootlessUID], fields[rootlessGID]
+	switch fields[rootlessDevice] {
+	case rootlessCharDevice:
+		fi.Mode = fi.Mode.Perm() | os.ModeDevice | os.ModeCharDevice
+	case rootlessBlockDevice:
+		fi.Mode = fi.Mode.Perm() | os.ModeDevice
+	}
+	if fi.Mode&os.ModeDevice != 0 {
+		fi.Major, fi.Minor = fields[rootlessMajor], fields[rootlessMinor]
+	}
+	return nil
+}
+
+// RestoreRootless returns a Reader of the files of r with the ownership and
+// devices recorded in RootlessXattr restored, the reverse of extracting
+// rootless, see WriteOptions.
+func RestoreRootless(r Reader) Reader {
+	return &rootlessReader{r: r}
+}
+
+type rootlessReader struct {
+	r Reader
+}
+
+func (r *rootlessReader) Next() (*File, error) {
+	f, err := r.r.Next()
+	if err != nil {
+		return nil, err
+	}
+	// Files extracted rootless are owned by the user extracting them, those
+	// recording no ownership are owned by root.
+	f.Uid, f.Gid = 0, 0
+	value, ok := f.Xattrs[RootlessXattr]
+	if !ok {
+		return f, nil
+	}
+	delete(f.Xattrs, RootlessXattr)
+	if err := restoreRootless(&f.FileInfo, []byte(value)); err != nil {
+		return nil, fmt.Errorf("parsing xattr %s of %q, %w", RootlessXattr, f.Name, err)
+	}
+
+	// The content of the placeholder of a device is dropped.
+	if f.Mode&os.ModeDevice != 0 && f.Data != nil {
+		if err := f.Data.Close(); err != nil {
+			return nil, fmt.Errorf("closing %q, %w", f.Name, err)
+		}
+		f.Size, f.Data = 0, nil
+	}
+	return f, nil
+}
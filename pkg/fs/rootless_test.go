@@ -0,0 +1,63 @@
+package fs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRootlessResource(t *testing.T) {
+	for _, fi := range []*FileInfo{
+		{Name: "root", Mode: 0644},
+		{Name: "user", Mode: 0644, Uid: 1000, Gid: 100},
+		{Name: "null", Mode: os.ModeDevice | os.ModeCharDevice | 0666, Major: 1, Minor: 3},
+		{Name: "sda", Mode: os.ModeDevice | 0660, Gid: 6, Major: 8},
+	} {
+		value := rootlessResource(fi)
+		if fi.Uid == 0 && fi.Gid == 0 && fi.Mode&os.ModeDevice == 0 && value != nil {
+			t.Errorf("%s, want nothing recorded, got %x", fi.Name, value)
+		}
+		// Devices are extracted as regular files.
+		got := &FileInfo{Name: fi.Name, Mode: fi.Mode.Perm()}
+		if err := restoreRootless(got, value); err != nil {
+			t.Fatalf("%s, %v", fi.Name, err)
+		}
+		if got.Uid != fi.Uid || got.Gid != fi.Gid || got.Mode != fi.Mode || got.Major != fi.Major || got.Minor != fi.Minor {
+			t.Errorf("%s, want %+v, got %+v", fi.Name, fi, got)
+		}
+	}
+}
+
+func TestRestoreRootlessUnknownFields(t *testing.T) {
+	value := []byte{
+		0x08, 0xe8, 0x07, // uid 1000
+		0x19, 1, 2, 3, 4, 5, 6, 7, 8, // field 3, fixed64
+		0x22, 2, 'h', 'i', // field 4, bytes
+		0x2d, 1, 2, 3, 4, // field 5, fixed32
+		0x80, 0x08, 0x01, // field 128, varint
+	}
+	fi := &FileInfo{Mode: 0644}
+	if err := restoreRootless(fi, value); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Uid != 1000 || fi.Gid != 0 {
+		t.Errorf("want 1000:0, got %d:%d", fi.Uid, fi.Gid)
+	}
+}
+
+func TestRestoreRootlessCorrupted(t *testing.T) {
+	for name, value := range map[string][]byte{
+		"truncated tag":     {0x80},
+		"truncated varint":  {0x08, 0xe8},
+		"missing varint":    {0x08},
+		"truncated fixed64": {0x19, 1, 2, 3},
+		"truncated fixed32": {0x2d, 1, 2},
+		"truncated bytes":   {0x22, 5, 'h', 'i'},
+		"huge bytes":        {0x22, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"group":             {0x0b},
+		"bad wire type":     {0x0e, 0},
+	} {
+		if err := restoreRootless(&FileInfo{Mode: 0644}, value); err == nil {
+			t.Errorf("%s, want an error", name)
+		}
+	}
+}
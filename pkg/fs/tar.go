@@ -2,16 +2,26 @@ package fs
 
 import (
 	"archive/tar"
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"strings"
 )
 
+// paxSchilyXattr is the prefix of PAX records carrying extended attributes.
+const paxSchilyXattr = "SCHILY.xattr."
+
+// ErrDataExpired is returned when reading the Data of a File after the Next
+// call following it.
+var ErrDataExpired = errors.New("reading file data after next file")
+
+// TarReader streams files out of a tar, the Data of each File reads straight
+// from the tar and is only valid until the next call of Next.
 type TarReader struct {
 	tr *tar.Reader
+	// Increased by every Next, to expire the Data of previous files.
+	seq uint64
 }
 
 func NewTarReader(tr *tar.Reader) Reader {
@@ -23,22 +33,22 @@ func NewTarReader(tr *tar.Reader) Reader {
 func (r *TarReader) Next() (*File, error) {
 	tr := r.tr
 
+	r.seq++
 	th, err := tr.Next()
 	if errors.Is(err, io.EOF) {
 		return nil, err
 	}
-
-	// TODO this will take up huge memory when the file is large.
-	content, err := ioutil.ReadAll(tr)
 	if err != nil {
-		return nil, fmt.Errorf("reading %q from tar: %w", th.Name, err)
+		return nil, fmt.Errorf("reading next header from tar: %w", err)
 	}
 
-	mode := os.FileMode(th.Mode)
+	mode := fileMode(th.Mode)
+	kind := KindNormal
 
 	switch th.Typeflag {
 	//case tar.TypeReg:
-	//case tar.TypeLink:
+	case tar.TypeLink:
+		kind = KindHardlink
 	case tar.TypeSymlink:
 		mode |= os.ModeSymlink
 	case tar.TypeChar:
@@ -52,22 +62,143 @@ func (r *TarReader) Next() (*File, error) {
 		mode |= os.ModeNamedPipe
 	}
 
+	// Whiteouts are regular files in tars, but carry no content.
+	name, size := th.Name, uint64(th.Size)
+	if th.Typeflag == tar.TypeReg {
+		if wkind, wname := ParseWhiteout(name); wkind != KindNormal {
+			kind, name, size = wkind, wname, 0
+		}
+	}
+
 	f := &File{
 		FileInfo: FileInfo{
-			Name:     th.Name,
-			Size:     uint64(th.Size),
+			Name:     name,
+			Size:     size,
+			Kind:     kind,
 			Uid:      uint32(th.Uid),
 			Gid:      uint32(th.Gid),
 			Mtime:    th.ModTime,
 			Atime:    th.AccessTime,
 			Ctime:    th.ChangeTime,
 			Mode:     mode,
-			Xattrs:   th.PAXRecords,
+			Xattrs:   xattrsFromPAX(th.PAXRecords),
 			Linkname: th.Linkname,
 			Major:    uint32(th.Devmajor),
 			Minor:    uint32(th.Devminor),
 		},
-		Data: ioutil.NopCloser(bytes.NewReader(content)),
+	}
+	if mode.IsRegular() && kind == KindNormal {
+		f.Data = &tarData{r: r, seq: r.seq}
 	}
 	return f, nil
 }
+
+// tarData reads the content of the current entry of a TarReader.
+type tarData struct {
+	r   *TarReader
+	seq uint64
+}
+
+func (d *tarData) Read(p []byte) (int, error) {
+	if d.seq != d.r.seq {
+		return 0, ErrDataExpired
+	}
+	return d.r.tr.Read(p)
+}
+
+// Close does nothing, the rest of the entry is skipped by the next Next.
+func (d *tarData) Close() error {
+	return nil
+}
+
+// xattrsFromPAX picks the extended attributes out of PAX records.
+func xattrsFromPAX(records map[string]string) map[string]string {
+	xattrs := map[string]string{}
+	for key, value := range records {
+		if strings.HasPrefix(key, paxSchilyXattr) {
+			xattrs[strings.TrimPrefix(key, paxSchilyXattr)] = value
+		}
+	}
+	return xattrs
+}
+
+// TarHeader returns the tar header of fi, the reverse of TarReader, with
+// whiteouts named in the OCI convention and xattrs in PAX records.
+func TarHeader(fi *FileInfo) *tar.Header {
+	th := &tar.Header{
+		Name:       fi.Name,
+		Mode:       tarMode(fi.Mode),
+		Uid:        int(fi.Uid),
+		Gid:        int(fi.Gid),
+		ModTime:    fi.Mtime,
+		AccessTime: fi.Atime,
+		ChangeTime: fi.Ctime,
+		Format:     tar.FormatPAX,
+	}
+	if len(fi.Xattrs) > 0 {
+		th.PAXRecords = map[string]string{}
+		for key, value := range fi.Xattrs {
+			th.PAXRecords[paxSchilyXattr+key] = value
+		}
+	}
+
+	switch {
+	case fi.Kind == KindWhiteout || fi.Kind == KindOpaque:
+		th.Typeflag = tar.TypeReg
+		th.Name = WhiteoutName(fi)
+	case fi.Kind == KindHardlink:
+		th.Typeflag = tar.TypeLink
+		th.Linkname = fi.Linkname
+	case fi.Mode&os.ModeSymlink != 0:
+		th.Typeflag = tar.TypeSymlink
+		th.Linkname = fi.Linkname
+	case fi.Mode&os.ModeDevice != 0:
+		th.Typeflag = tar.TypeBlock
+		if fi.Mode&os.ModeCharDevice != 0 {
+			th.Typeflag = tar.TypeChar
+		}
+		th.Devmajor = int64(fi.Major)
+		th.Devminor = int64(fi.Minor)
+	case fi.Mode.IsDir():
+		th.Typeflag = tar.TypeDir
+	case fi.Mode&os.ModeNamedPipe != 0:
+		th.Typeflag = tar.TypeFifo
+	default:
+		th.Typeflag = tar.TypeReg
+		th.Size = int64(fi.Size)
+	}
+	return th
+}
+
+// fileMode returns the permission bits of tar headers as an os.FileMode,
+// with the setuid, setgid and sticky bits as os.ModeSetuid and so on.
+func fileMode(m int64) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// tarMode returns the permission bits of mode as stored in tar headers, the
+// reverse of fileMode. Star files written from tars by older stars keep the
+// setuid, setgid and sticky bits as in tar headers, which are kept so.
+func tarMode(mode os.FileMode) int64 {
+	m := int64(mode & 07777)
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
@@ -0,0 +1,91 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTarReaderModeBits(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	headers := []*tar.Header{
+		{Name: "suid", Typeflag: tar.TypeReg, Mode: 04755},
+		{Name: "sgid", Typeflag: tar.TypeReg, Mode: 02755},
+		{Name: "tmp", Typeflag: tar.TypeDir, Mode: 01777},
+	}
+	for _, th := range headers {
+		if err := tw.WriteHeader(th); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []os.FileMode{
+		os.ModeSetuid | 0755,
+		os.ModeSetgid | 0755,
+		os.ModeDir | os.ModeSticky | 0777,
+	}
+	r := NewTarReader(tar.NewReader(&buf))
+	for i, th := range headers {
+		f, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Mode != want[i] {
+			t.Errorf("mode of %q, want %v, got %v", th.Name, want[i], f.Mode)
+		}
+		if got := TarHeader(&f.FileInfo).Mode; got != th.Mode {
+			t.Errorf("tar mode of %q, want %o, got %o", th.Name, th.Mode, got)
+		}
+	}
+}
+
+func TestTarReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := bytes.Repeat([]byte("x"), 2048)
+	if err := tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// Cut inside the content of a, and inside the header of b.
+	for _, n := range []int{1024, 512 + 2048 + 100} {
+		r := NewTarReader(tar.NewReader(bytes.NewReader(data[:n])))
+		f, err := r.Next()
+		if err != nil {
+			t.Fatalf("cut at %d, first header: %v", n, err)
+		}
+		_, rerr := ioutil.ReadAll(f.Data)
+		_, nerr := r.Next()
+		if rerr == nil && nerr == nil {
+			t.Errorf("cut at %d, want an error", n)
+		}
+		if errors.Is(nerr, io.EOF) {
+			t.Errorf("cut at %d, want an error other than EOF, got %v", n, nerr)
+		}
+	}
+
+	// A corrupted checksum is no end of archive either.
+	bad := append([]byte(nil), data...)
+	bad[148] ^= 0xff
+	if _, err := NewTarReader(tar.NewReader(bytes.NewReader(bad))).Next(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("corrupted header, want an error, got %v", err)
+	}
+}
@@ -9,48 +9,160 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func Chall(fi *FileInfo) error {
-	if err := os.Lchown(fi.Name, int(fi.Uid), int(fi.Gid)); err != nil {
-		return fmt.Errorf("chown %q, %s", fi.Name, err)
-	}
-
-	// TODO utime not work for symlink
-
-	if (fi.Mode & os.ModeType) != os.ModeSymlink {
-		err := unix.Utimes(fi.Name, []unix.Timeval{
-			{
-				Sec:  fi.Atime.Unix(),
-				Usec: (fi.Atime.UnixNano() / 1000000) % 1000,
-			},
-			{
-				Sec:  fi.Mtime.Unix(),
-				Usec: (fi.Mtime.UnixNano() / 1000000) % 1000,
-			},
-		})
+// WriteOptions configure writing files, nil writes as root does.
+type WriteOptions struct {
+	// Rootless skips what needs privileges: the ownership, and the device
+	// of device nodes, are recorded in RootlessXattr instead, device nodes
+	// are created as empty regular files, and xattrs not settable are
+	// skipped. As the owner needs write permission to set xattrs and to
+	// write files into directories, like umoci, files get their mode once
+	// their xattrs are set, and directories are left writable until
+	// RestoreDirMode.
+	Rootless bool
+}
+
+func Chall(fi *FileInfo, opts *WriteOptions) error {
+	if opts != nil && opts.Rootless {
+		if err := setRootless(fi); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Lchown(fi.Name, int(fi.Uid), int(fi.Gid)); err != nil {
+			return fmt.Errorf("chown %q, %s", fi.Name, err)
+		}
+
+		// Set after chown, which drops security.capability.
+		if err := Lsetxattrs(fi); err != nil {
+			return err
+		}
+	}
+
+	// Not following symlinks, which could point out of the files written.
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, fi.Name, []unix.Timespec{
+		unix.NsecToTimespec(fi.Atime.UnixNano()),
+		unix.NsecToTimespec(fi.Mtime.UnixNano()),
+	}, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fmt.Errorf("utimes %q, atime %s, mtime %s, %s", fi.Name, fi.Atime, fi.Mtime, err)
+	}
+	return nil
+}
+
+// setRootless sets the xattrs of fi a user could set, and records what the
+// user could not do in RootlessXattr. The owner is given write permission
+// to set them, and fi gets its mode afterwards, unless it is a directory,
+// see RestoreDirMode. Symlinks have no mode of their own.
+func setRootless(fi *FileInfo) error {
+	symlink := fi.Mode&os.ModeSymlink != 0
+	if !symlink {
+		if err := chmod(fi.Name, rootlessMode(fi.Mode)); err != nil {
+			return fmt.Errorf("chmod %q with %o, %s", fi.Name, rootlessMode(fi.Mode), err)
+		}
+	}
+
+	for key, value := range fi.Xattrs {
+		err := unix.Lsetxattr(fi.Name, key, []byte(value), 0)
+		if err == unix.EPERM || err == unix.ENOTSUP {
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("utimes %q, atime %s, mtime %s, %s", fi.Name, fi.Atime, fi.Mtime, err)
+			return fmt.Errorf("lsetxattr %q of %q, %s", key, fi.Name, err)
+		}
+	}
+
+	// Symlinks could not have user xattrs, so they are left owned by root.
+	resource := rootlessResource(fi)
+	if len(resource) > 0 && !symlink {
+		if err := unix.Lsetxattr(fi.Name, RootlessXattr, resource, 0); err != nil {
+			return fmt.Errorf("lsetxattr %q of %q, %s", RootlessXattr, fi.Name, err)
+		}
+	}
+
+	if !symlink && !fi.Mode.IsDir() {
+		if err := chmod(fi.Name, fi.Mode); err != nil {
+			return fmt.Errorf("chmod %q with %o, %s", fi.Name, fi.Mode, err)
 		}
 	}
 	return nil
 }
 
-func MkdirAll(fi *FileInfo) error {
-	if err := os.MkdirAll(fi.Name, fi.Mode); err != nil {
+func MkdirAll(fi *FileInfo, opts *WriteOptions) error {
+	mode := fi.Mode
+	if opts != nil && opts.Rootless {
+		mode = rootlessMode(mode)
+	}
+	// A file in the way is replaced, and a symlink not followed, which could
+	// point out of the files written.
+	if st, err := os.Lstat(fi.Name); err == nil && !st.IsDir() {
+		if err := os.Remove(fi.Name); err != nil {
+			return fmt.Errorf("removing %q, %s", fi.Name, err)
+		}
+	}
+	if err := os.MkdirAll(fi.Name, mode); err != nil {
 		return fmt.Errorf("mkdirall %q, %s", fi.Name, err)
 	}
-	return Chall(fi)
+	return Chall(fi, opts)
 }
 
-func Symlink(fi *FileInfo) error {
+// RestoreDirMode sets the mode of the directory fi, left writable by the
+// owner while writing files into it rootless. Directories are restored
+// once all files are written, the deepest first, as a directory without
+// write or search permission could not be written into.
+func RestoreDirMode(fi *FileInfo, opts *WriteOptions) error {
+	if opts == nil || !opts.Rootless {
+		return nil
+	}
+	if err := chmod(fi.Name, fi.Mode); err != nil {
+		return fmt.Errorf("chmod %q with %o, %s", fi.Name, fi.Mode, err)
+	}
+	return nil
+}
+
+// chmod sets the mode of name, not following name if a symlink, nor if not
+// a directory while mode is one, as os.Chmod would. The file is opened
+// O_PATH, which fchmod does not take, so it is chmodded through /proc.
+func chmod(name string, mode os.FileMode) error {
+	flags := unix.O_PATH | unix.O_NOFOLLOW | unix.O_CLOEXEC
+	if mode.IsDir() {
+		flags |= unix.O_DIRECTORY
+	}
+	fd, err := unix.Open(name, flags, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), uint32(tarMode(mode)))
+}
+
+// rootlessMode returns mode with the owner permissions needed to set xattrs
+// of a file, and to write files into a directory.
+func rootlessMode(mode os.FileMode) os.FileMode {
+	if mode.IsDir() {
+		return mode | 0700
+	}
+	return mode | 0600
+}
+
+func Symlink(fi *FileInfo, opts *WriteOptions) error {
 	if err := os.Symlink(fi.Linkname, fi.Name); err != nil {
 		return fmt.Errorf("symlink %s -> %s, %s", fi.Name, fi.Linkname, err)
 	}
-	return Chall(fi)
+	return Chall(fi, opts)
+}
+
+// Link creates the hard link fi.Name to fi.Linkname, which shares the
+// metadata of its target.
+func Link(fi *FileInfo) error {
+	if err := os.Link(fi.Linkname, fi.Name); err != nil {
+		return fmt.Errorf("link %s => %s, %s", fi.Name, fi.Linkname, err)
+	}
+	return nil
 }
 
 // Mknod creates a filesystem node (file, device special file or named pipe) named path
-// with attributes specified by mode and dev.
-func Mknod(fi *FileInfo) error {
+// with attributes specified by mode and dev. Rootless, it creates an empty
+// regular file in place of the device.
+func Mknod(fi *FileInfo, opts *WriteOptions) error {
 	var mode uint32
 	switch fi.Mode & os.ModeType {
 	case os.ModeDevice:
@@ -58,13 +170,17 @@ func Mknod(fi *FileInfo) error {
 	case os.ModeDevice | os.ModeCharDevice:
 		mode = unix.S_IFCHR
 	}
-	if err := unix.Mknod(fi.Name, mode, int(mkdev(fi.Major, fi.Minor))); err != nil {
+	dev := mkdev(fi.Major, fi.Minor)
+	if opts != nil && opts.Rootless {
+		mode, dev = unix.S_IFREG, 0
+	}
+	if err := unix.Mknod(fi.Name, mode, int(dev)); err != nil {
 		return fmt.Errorf("mknod %q with (%d,%d), %s", fi.Name, fi.Major, fi.Minor, err)
 	}
-	if err := os.Chmod(fi.Name, fi.Mode); err != nil {
+	if err := chmod(fi.Name, fi.Mode); err != nil {
 		return fmt.Errorf("chmod %q with %o, %s", fi.Name, fi.Mode, err)
 	}
-	return Chall(fi)
+	return Chall(fi, opts)
 }
 
 // Mkdev is used to build the value of linux devices (in /dev/) which specifies major
@@ -0,0 +1,86 @@
+// +build linux
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteRootlessReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	opts := &WriteOptions{Rootless: true}
+	mtime := time.Unix(1600000000, 0)
+
+	dfi := &FileInfo{Name: filepath.Join(dir, "ro"), Mode: os.ModeDir | 0555, Uid: 1000, Gid: 1000, Mtime: mtime, Atime: mtime}
+	if err := MkdirAll(dfi, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !xattrsSupported(t, dfi.Name) {
+		t.Skip("no user xattrs in", dir)
+	}
+	if st, err := os.Stat(dfi.Name); err != nil || st.Mode().Perm()&0700 != 0700 {
+		t.Fatalf("want %q writable by the owner, got %v %v", dfi.Name, st.Mode(), err)
+	}
+
+	// Written into the directory left writable.
+	ffi := &FileInfo{Name: filepath.Join(dfi.Name, "f"), Mode: 0444, Uid: 1000, Gid: 1000, Mtime: mtime, Atime: mtime}
+	f, err := os.OpenFile(ffi.Name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, ffi.Mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := Chall(ffi, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(t, ffi.Name, 0444)
+	checkRootlessXattr(t, ffi.Name)
+
+	if err := RestoreDirMode(dfi, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(t, dfi.Name, os.ModeDir|0555)
+	checkRootlessXattr(t, dfi.Name)
+	os.Chmod(dfi.Name, 0755)
+}
+
+func xattrsSupported(t *testing.T, name string) bool {
+	t.Helper()
+	err := unix.Lsetxattr(name, "user.test", []byte("1"), 0)
+	if err == unix.ENOTSUP {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Lremovexattr(name, "user.test")
+	return true
+}
+
+func checkMode(t *testing.T, name string, want os.FileMode) {
+	t.Helper()
+	st, err := os.Lstat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != want {
+		t.Errorf("mode of %q, want %s, got %s", name, want, st.Mode())
+	}
+}
+
+func checkRootlessXattr(t *testing.T, name string) {
+	t.Helper()
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(name, RootlessXattr, buf)
+	if err != nil {
+		t.Fatalf("getting %s of %q, %s", RootlessXattr, name, err)
+	}
+	var fi FileInfo
+	if err := restoreRootless(&fi, buf[:n]); err != nil || fi.Uid != 1000 || fi.Gid != 1000 {
+		t.Errorf("%s of %q, want uid 1000 gid 1000, got %d %d %v", RootlessXattr, name, fi.Uid, fi.Gid, err)
+	}
+}
@@ -0,0 +1,94 @@
+// +build linux
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overlayOpaqueXattr marks opaque directories in overlayfs upper dirs.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// UpperReader reads the upper directory of an overlay as a layer, named
+// relative to the directory. Deletions are recorded the OCI way, as written
+// by star mount --upper, or the overlayfs way, as character devices 0/0 and
+// directories with the trusted.overlay.opaque xattr, both are read as
+// KindWhiteout and KindOpaque entries.
+type UpperReader struct {
+	r      Reader
+	prefix string
+	// Opaque entry following the directory just read.
+	opaque *File
+}
+
+// NewUpperReader returns an UpperReader of the directory dir.
+func NewUpperReader(dir string) (Reader, error) {
+	fis, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading dir %q, %w", dir, err)
+	}
+	files := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		files = append(files, filepath.Join(dir, fi.Name()))
+	}
+	if len(files) == 0 {
+		return &UpperReader{r: emptyReader{}}, nil
+	}
+
+	lr, err := NewLocalReader(files...)
+	if err != nil {
+		return nil, err
+	}
+	return &UpperReader{r: lr, prefix: filepath.Clean(dir) + string(filepath.Separator)}, nil
+}
+
+func (r *UpperReader) Next() (*File, error) {
+	if f := r.opaque; f != nil {
+		r.opaque = nil
+		return f, nil
+	}
+
+	f, err := r.r.Next()
+	if err != nil {
+		return nil, err
+	}
+	f.Name = filepath.ToSlash(strings.TrimPrefix(f.Name, r.prefix))
+	if f.Kind == KindHardlink {
+		f.Linkname = filepath.ToSlash(strings.TrimPrefix(f.Linkname, r.prefix))
+	}
+
+	switch {
+	case f.Mode.IsRegular() && f.Kind == KindNormal:
+		if kind, name := ParseWhiteout(f.Name); kind != KindNormal {
+			if err := f.Data.Close(); err != nil {
+				return nil, fmt.Errorf("closing %q, %w", f.Name, err)
+			}
+			f.Kind, f.Name, f.Size, f.Data = kind, name, 0, nil
+		}
+	case f.Mode&os.ModeCharDevice != 0 && f.Major == 0 && f.Minor == 0:
+		f.Kind, f.Mode = KindWhiteout, f.Mode.Perm()
+	case f.Mode.IsDir() && f.Xattrs[overlayOpaqueXattr] == "y":
+		delete(f.Xattrs, overlayOpaqueXattr)
+		r.opaque = &File{FileInfo: FileInfo{
+			Name:  f.Name,
+			Kind:  KindOpaque,
+			Uid:   f.Uid,
+			Gid:   f.Gid,
+			Mtime: f.Mtime,
+			Atime: f.Atime,
+			Ctime: f.Ctime,
+		}}
+	}
+	return f, nil
+}
+
+// emptyReader reads no files.
+type emptyReader struct{}
+
+func (emptyReader) Next() (*File, error) {
+	return nil, io.EOF
+}
@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// WhiteoutPrefix prefixes the base name of a deleted file in OCI layer
+	// tars, ".wh.<name>" deletes <name> of lower layers.
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaque is the base name of the entry marking the directory it
+	// lives in as opaque in OCI layer tars.
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// ParseWhiteout returns the kind of an entry named name in the OCI
+// convention, and the name of the file it deletes, or of the opaque
+// directory. Other entries, including those deleting "." or "..", are
+// KindNormal and keep their name.
+func ParseWhiteout(name string) (Kind, string) {
+	dir, base := path.Split(name)
+	switch deleted := strings.TrimPrefix(base, WhiteoutPrefix); {
+	case base == WhiteoutOpaque:
+		if dir = strings.TrimSuffix(dir, "/"); len(dir) == 0 {
+			dir = "."
+		}
+		return KindOpaque, dir
+	case len(deleted) < len(base) && deleted != "" && deleted != "." && deleted != "..":
+		return KindWhiteout, dir + deleted
+	}
+	return KindNormal, name
+}
+
+// WhiteoutName returns the name of a whiteout or opaque entry in the OCI
+// convention, which is Name for other entries.
+func WhiteoutName(fi *FileInfo) string {
+	switch fi.Kind {
+	case KindWhiteout:
+		dir, base := path.Split(fi.Name)
+		return dir + WhiteoutPrefix + base
+	case KindOpaque:
+		return path.Join(fi.Name, WhiteoutOpaque)
+	}
+	return fi.Name
+}
+
+// ApplyWhiteout deletes the file of a whiteout entry, or the content of the
+// directory of an opaque entry, on the local filesystem.
+func ApplyWhiteout(fi *FileInfo) error {
+	name := filepath.FromSlash(fi.Name)
+	switch fi.Kind {
+	case KindWhiteout:
+		if err := os.RemoveAll(name); err != nil {
+			return fmt.Errorf("deleting %q, %w", name, err)
+		}
+	case KindOpaque:
+		// Not following a symlink to clear the directory it points to.
+		if st, err := os.Lstat(name); err != nil || !st.IsDir() {
+			return nil
+		}
+		fis, err := ioutil.ReadDir(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading dir %q, %w", name, err)
+		}
+		for _, fi := range fis {
+			child := filepath.Join(name, fi.Name())
+			if err := os.RemoveAll(child); err != nil {
+				return fmt.Errorf("deleting %q, %w", child, err)
+			}
+		}
+	default:
+		return fmt.Errorf("%q is not a whiteout", fi.Name)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseWhiteout(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		kind     Kind
+		wantName string
+	}{
+		{"etc/.wh.hosts", KindWhiteout, "etc/hosts"},
+		{".wh.etc", KindWhiteout, "etc"},
+		{"a/.wh..wh.b", KindWhiteout, "a/.wh.b"},
+		{"etc/.wh..wh..opq", KindOpaque, "etc"},
+		{".wh..wh..opq", KindOpaque, "."},
+		{"etc/hosts", KindNormal, "etc/hosts"},
+		{"etc/.wh.", KindNormal, "etc/.wh."},
+		{"etc/.wh..", KindNormal, "etc/.wh.."},
+		{"etc/.wh...", KindNormal, "etc/.wh..."},
+		{"etc/.wh.hosts/x", KindNormal, "etc/.wh.hosts/x"},
+		{"etc/x.wh.hosts", KindNormal, "etc/x.wh.hosts"},
+	} {
+		kind, name := ParseWhiteout(c.name)
+		if kind != c.kind || name != c.wantName {
+			t.Errorf("%q, want %v %q, got %v %q", c.name, c.kind, c.wantName, kind, name)
+		}
+		if kind != KindNormal {
+			if got := WhiteoutName(&FileInfo{Name: name, Kind: kind}); got != c.name {
+				t.Errorf("whiteout name of %q, want %q, got %q", name, c.name, got)
+			}
+		}
+	}
+}
+
+func TestApplyWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "star-whiteout-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, name := range []string{"etc/hosts", "etc/passwd", "usr/bin/env", "usr/lib/libc", "outside/keep"} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("outside", "link"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fi := range []*FileInfo{
+		{Name: "etc/hosts", Kind: KindWhiteout},
+		{Name: "usr/lib", Kind: KindWhiteout},
+		{Name: "usr/missing", Kind: KindWhiteout},
+		{Name: "usr", Kind: KindOpaque},
+		{Name: "link", Kind: KindOpaque},
+		{Name: "missing", Kind: KindOpaque},
+	} {
+		if err := ApplyWhiteout(fi); err != nil {
+			t.Errorf("applying %v %q, %s", fi.Kind, fi.Name, err)
+		}
+	}
+	if err := ApplyWhiteout(&FileInfo{Name: "etc/passwd"}); err == nil {
+		t.Errorf("applying a normal entry, want error")
+	}
+
+	var got []string
+	err = filepath.Walk(".", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." {
+			got = append(got, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{"etc", "etc/passwd", "link", "outside", "outside/keep", "usr"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files left, want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,76 @@
+// +build linux darwin
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// lgetxattrs returns all extended attributes of name, without following
+// symlinks. Filesystems not supporting xattrs have none.
+func lgetxattrs(name string) (map[string]string, error) {
+	xattrs := map[string]string{}
+
+	keys, err := lxattrCall(func(dest []byte) (int, error) {
+		return unix.Llistxattr(name, dest)
+	})
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return xattrs, nil
+		}
+		return nil, fmt.Errorf("llistxattr %q, %w", name, err)
+	}
+
+	for _, key := range bytes.Split(keys, []byte{0}) {
+		if len(key) == 0 {
+			continue
+		}
+		value, err := lxattrCall(func(dest []byte) (int, error) {
+			return unix.Lgetxattr(name, string(key), dest)
+		})
+		if err != nil {
+			if err == unix.ENODATA {
+				continue
+			}
+			return nil, fmt.Errorf("lgetxattr %q of %q, %w", key, name, err)
+		}
+		xattrs[string(key)] = string(value)
+	}
+	return xattrs, nil
+}
+
+// lxattrCall calls a listxattr or getxattr like function, growing the
+// buffer until the result fits.
+func lxattrCall(call func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		dest := make([]byte, size)
+		size, err = call(dest)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dest[:size], nil
+	}
+}
+
+// Lsetxattrs sets all extended attributes of fi, without following symlinks.
+func Lsetxattrs(fi *FileInfo) error {
+	for key, value := range fi.Xattrs {
+		if err := unix.Lsetxattr(fi.Name, key, []byte(value), 0); err != nil {
+			return fmt.Errorf("lsetxattr %q of %q, %s", key, fi.Name, err)
+		}
+	}
+	return nil
+}
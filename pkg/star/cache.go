@@ -0,0 +1,349 @@
+package star
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+const (
+	// DefaultCacheBlockSize is the size of blocks read from the source.
+	DefaultCacheBlockSize = 1 << 20
+	// DefaultCacheMemory is the most bytes of blocks kept in memory.
+	DefaultCacheMemory = 64 << 20
+)
+
+// CachedReaderAt caches an io.ReaderAt in blocks aligned to the block size,
+// so small reads of a remote star file do not cost a round trip each. Blocks
+// are kept in memory up to a limit, evicting the least recently used ones,
+// and optionally in a directory on disk. Concurrent reads missing the same
+// block wait for one read of the source.
+type CachedReaderAt struct {
+	r         io.ReaderAt
+	size      int64
+	blockSize int64
+	maxBlocks int
+	dir       string
+
+	mu sync.Mutex
+	// Blocks in memory by index, and their indexes from most to least
+	// recently used.
+	blocks   map[int64]*list.Element
+	lru      *list.List
+	inflight map[int64]*blockCall
+	// Number of on-demand reads of the source in flight, which prefetching
+	// yields to.
+	demand int32
+
+	hits, diskHits, misses, prefetched uint64
+}
+
+// cachedBlock is a block kept in memory.
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+// blockCall is a read of a missing block others could wait for.
+type blockCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// CacheStats counts the blocks read through a CachedReaderAt.
+type CacheStats struct {
+	// Blocks found in memory, or being read for another reader.
+	Hits uint64
+	// Blocks found on disk.
+	DiskHits uint64
+	// Blocks read from the source.
+	Misses uint64
+	// Blocks read from the source by prefetching.
+	Prefetched uint64
+}
+
+// NewCachedReaderAt returns a CachedReaderAt over the first size bytes of r,
+// keeping up to memory bytes of blocks of blockSize in memory.
+func NewCachedReaderAt(r io.ReaderAt, size int64, blockSize int, memory int64) (*CachedReaderAt, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("cache block size want > 0, got %d", blockSize)
+	}
+	maxBlocks := int(memory / int64(blockSize))
+	if maxBlocks < 1 {
+		maxBlocks = 1
+	}
+	c := &CachedReaderAt{
+		r:         r,
+		size:      size,
+		blockSize: int64(blockSize),
+		maxBlocks: maxBlocks,
+		blocks:    map[int64]*list.Element{},
+		lru:       list.New(),
+		inflight:  map[int64]*blockCall{},
+	}
+	return c, nil
+}
+
+// SetDiskCache keeps blocks in dir as well, which is created if missing. The
+// directory must only hold blocks of this source. Blocks on disk are never
+// evicted, one file per block, so dir grows up to the size of the source,
+// and removing it, or any of its blocks, is left to the user.
+func (c *CachedReaderAt) SetDiskCache(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating cache dir %q, %w", dir, err)
+	}
+	c.dir = dir
+	return nil
+}
+
+// Size returns the size of the source.
+func (c *CachedReaderAt) Size() int64 {
+	return c.size
+}
+
+// Stats returns the counters of blocks read so far.
+func (c *CachedReaderAt) Stats() CacheStats {
+	return CacheStats{
+		Hits:       atomic.LoadUint64(&c.hits),
+		DiskHits:   atomic.LoadUint64(&c.diskHits),
+		Misses:     atomic.LoadUint64(&c.misses),
+		Prefetched: atomic.LoadUint64(&c.prefetched),
+	}
+}
+
+func (c *CachedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("ReaderAt want off >= 0, got %d", off)
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if off+int64(len(p)) > c.size {
+		p = p[:c.size-off]
+		err = io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / c.blockSize
+		data, berr := c.block(index)
+		if berr != nil {
+			return n, berr
+		}
+		n += copy(p[n:], data[pos-index*c.blockSize:])
+	}
+	return n, err
+}
+
+// block returns the block of index, from memory, disk or the source.
+func (c *CachedReaderAt) block(index int64) ([]byte, error) {
+	c.mu.Lock()
+	if e, ok := c.blocks[index]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return e.Value.(*cachedBlock).data, nil
+	}
+	if call, ok := c.inflight[index]; ok {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		<-call.done
+		return call.data, call.err
+	}
+	call := &blockCall{done: make(chan struct{})}
+	c.inflight[index] = call
+	c.mu.Unlock()
+
+	atomic.AddInt32(&c.demand, 1)
+	call.data, call.err = c.load(index)
+	atomic.AddInt32(&c.demand, -1)
+
+	c.mu.Lock()
+	delete(c.inflight, index)
+	if call.err == nil {
+		c.add(index, call.data)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.data, call.err
+}
+
+// prefetch makes sure the block of index is cached, reading it from the
+// source if missing, and tells whether it was read. With a disk cache, the
+// block is only kept on disk, so prefetching does not evict blocks in use.
+func (c *CachedReaderAt) prefetch(index int64) (bool, error) {
+	// Stat outside of the lock, so reads of cached blocks do not wait for
+	// the disk.
+	if len(c.dir) > 0 && c.onDisk(index) {
+		return false, nil
+	}
+
+	c.mu.Lock()
+	if _, ok := c.blocks[index]; ok && len(c.dir) == 0 {
+		c.mu.Unlock()
+		return false, nil
+	}
+	if call, ok := c.inflight[index]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return false, call.err
+	}
+	call := &blockCall{done: make(chan struct{})}
+	c.inflight[index] = call
+	c.mu.Unlock()
+
+	call.data, call.err = c.readBlock(index)
+	if call.err == nil {
+		atomic.AddUint64(&c.prefetched, 1)
+		if len(c.dir) > 0 {
+			c.store(index, call.data)
+		}
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, index)
+	if call.err == nil && len(c.dir) == 0 {
+		c.add(index, call.data)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.err == nil, call.err
+}
+
+// Preload caches the blocks covering length bytes at off with one read of
+// the source, unless all of them are cached, e.g. to fetch the hot files of a
+// star file at startup, see Reader.HotEnd.
+func (c *CachedReaderAt) Preload(off, length int64) error {
+	if off < 0 || length <= 0 || off >= c.size {
+		return nil
+	}
+	first := off / c.blockSize
+	last := (off + length - 1) / c.blockSize
+	if last >= c.numBlocks() {
+		last = c.numBlocks() - 1
+	}
+
+	var inMemory []bool
+	c.mu.Lock()
+	for index := first; index <= last; index++ {
+		_, ok := c.blocks[index]
+		inMemory = append(inMemory, ok)
+	}
+	c.mu.Unlock()
+	missing := false
+	for index := first; index <= last && !missing; index++ {
+		missing = !inMemory[index-first] && !(len(c.dir) > 0 && c.onDisk(index))
+	}
+	if !missing {
+		return nil
+	}
+
+	start := first * c.blockSize
+	data := make([]byte, last*c.blockSize+c.blockLen(last)-start)
+	n, err := c.r.ReadAt(data, start)
+	if err != nil && !(err == io.EOF && n == len(data)) {
+		return fmt.Errorf("preloading [%d, %d), read %d bytes, err %w", start, start+int64(len(data)), n, err)
+	}
+
+	for index := first; index <= last; index++ {
+		at := (index - first) * c.blockSize
+		block := data[at : at+c.blockLen(index) : at+c.blockLen(index)]
+		if len(c.dir) > 0 {
+			c.store(index, block)
+		}
+		c.mu.Lock()
+		if _, ok := c.blocks[index]; !ok {
+			c.add(index, block)
+		}
+		c.mu.Unlock()
+		atomic.AddUint64(&c.prefetched, 1)
+	}
+	return nil
+}
+
+// numBlocks returns the number of blocks of the source.
+func (c *CachedReaderAt) numBlocks() int64 {
+	return (c.size + c.blockSize - 1) / c.blockSize
+}
+
+// blockLen returns the length of the block of index, the last one could be
+// shorter than the block size.
+func (c *CachedReaderAt) blockLen(index int64) int64 {
+	start := index * c.blockSize
+	if start+c.blockSize > c.size {
+		return c.size - start
+	}
+	return c.blockSize
+}
+
+// onDisk tells whether the block of index is in the disk cache.
+func (c *CachedReaderAt) onDisk(index int64) bool {
+	fi, err := os.Stat(c.blockPath(index))
+	return err == nil && fi.Size() == c.blockLen(index)
+}
+
+// add keeps a block in memory, evicting the least recently used blocks.
+func (c *CachedReaderAt) add(index int64, data []byte) {
+	c.blocks[index] = c.lru.PushFront(&cachedBlock{index: index, data: data})
+	for c.lru.Len() > c.maxBlocks {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.blocks, e.Value.(*cachedBlock).index)
+	}
+}
+
+// load reads a block missing in memory from disk, or from the source.
+func (c *CachedReaderAt) load(index int64) ([]byte, error) {
+	if len(c.dir) > 0 {
+		// A short or missing block file is a miss, the block is read again.
+		data, err := ioutil.ReadFile(c.blockPath(index))
+		if err == nil && int64(len(data)) == c.blockLen(index) {
+			atomic.AddUint64(&c.diskHits, 1)
+			return data, nil
+		}
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	data, err := c.readBlock(index)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.dir) > 0 {
+		c.store(index, data)
+	}
+	return data, nil
+}
+
+// readBlock reads the block of index from the source.
+func (c *CachedReaderAt) readBlock(index int64) ([]byte, error) {
+	data := make([]byte, c.blockLen(index))
+	n, err := c.r.ReadAt(data, index*c.blockSize)
+	if err != nil && !(err == io.EOF && n == len(data)) {
+		return nil, fmt.Errorf("reading block %d, read %d bytes, err %w", index, n, err)
+	}
+	return data, nil
+}
+
+// store writes a block to disk. Failures only cost reading the block again.
+func (c *CachedReaderAt) store(index int64, data []byte) {
+	fs.WriteFileAtomic(c.blockPath(index), 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (c *CachedReaderAt) blockPath(index int64) string {
+	return filepath.Join(c.dir, strconv.FormatInt(c.blockSize, 10)+"-"+strconv.FormatInt(index, 10))
+}
@@ -0,0 +1,155 @@
+package star
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingReaderAt counts the reads of a source, blocking them until release
+// is closed if it is not nil.
+type countingReaderAt struct {
+	r       io.ReaderAt
+	reads   int32
+	release chan struct{}
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt32(&r.reads, 1)
+	if r.release != nil {
+		<-r.release
+	}
+	return r.r.ReadAt(p, off)
+}
+
+const testCacheContent = "0123456789abcdefghij"
+
+func newTestCache(t *testing.T, src *countingReaderAt, blocks int64) *CachedReaderAt {
+	t.Helper()
+	// Blocks of 4 bytes, the last of 20 is full.
+	c, err := NewCachedReaderAt(src, int64(len(testCacheContent)), 4, blocks*4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func readCached(t *testing.T, c *CachedReaderAt, off int64, n int) string {
+	t.Helper()
+	p := make([]byte, n)
+	m, err := c.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return string(p[:m])
+}
+
+func TestCachedReaderAtLRU(t *testing.T) {
+	src := &countingReaderAt{r: strings.NewReader(testCacheContent)}
+	c := newTestCache(t, src, 2)
+
+	// Blocks 0 and 1, then 0 again, so 1 is the least recently used.
+	if got := readCached(t, c, 2, 4); got != "2345" {
+		t.Errorf("want \"2345\", got %q", got)
+	}
+	readCached(t, c, 0, 1)
+	// Block 2 evicts block 1.
+	readCached(t, c, 8, 1)
+	if reads := atomic.LoadInt32(&src.reads); reads != 3 {
+		t.Errorf("want 3 reads of the source, got %d", reads)
+	}
+	readCached(t, c, 0, 1)
+	if reads := atomic.LoadInt32(&src.reads); reads != 3 {
+		t.Errorf("block 0 recently used, want it kept, got %d reads", reads)
+	}
+	readCached(t, c, 4, 1)
+	if reads := atomic.LoadInt32(&src.reads); reads != 4 {
+		t.Errorf("block 1 least recently used, want it evicted, got %d reads", reads)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 4 {
+		t.Errorf("want 2 hits 4 misses, got %+v", stats)
+	}
+	if got := readCached(t, c, 16, 10); got != "ghij" {
+		t.Errorf("read beyond the end, want \"ghij\", got %q", got)
+	}
+}
+
+func TestCachedReaderAtSingleFlight(t *testing.T) {
+	src := &countingReaderAt{r: strings.NewReader(testCacheContent), release: make(chan struct{})}
+	c := newTestCache(t, src, 2)
+
+	const readers = 8
+	var (
+		wg  sync.WaitGroup
+		got = make([]string, readers)
+	)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := make([]byte, 3)
+			n, _ := c.ReadAt(p, 5)
+			got[i] = string(p[:n])
+		}(i)
+	}
+	// Every reader but the one reading the source waits for its read, and
+	// counts a hit, before the read returns.
+	for c.Stats().Hits < readers-1 {
+		runtime.Gosched()
+	}
+	close(src.release)
+	wg.Wait()
+
+	for i, s := range got {
+		if s != "567" {
+			t.Errorf("reader %d, want \"567\", got %q", i, s)
+		}
+	}
+	if reads := atomic.LoadInt32(&src.reads); reads != 1 {
+		t.Errorf("want 1 read of the source, got %d", reads)
+	}
+}
+
+func TestCachedReaderAtDisk(t *testing.T) {
+	dir := t.TempDir()
+	src := &countingReaderAt{r: strings.NewReader(testCacheContent)}
+	c := newTestCache(t, src, 1)
+	if err := c.SetDiskCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Preload(0, int64(len(testCacheContent))); err != nil {
+		t.Fatal(err)
+	}
+	if reads := atomic.LoadInt32(&src.reads); reads != 1 {
+		t.Errorf("preload, want 1 read of the source, got %d", reads)
+	}
+
+	// Another cache of the same source finds every block on disk.
+	src2 := &countingReaderAt{r: strings.NewReader(testCacheContent)}
+	c2 := newTestCache(t, src2, 1)
+	if err := c2.SetDiskCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.NewSectionReader(c2, 0, c2.Size())); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != testCacheContent {
+		t.Errorf("want %q, got %q", testCacheContent, buf.String())
+	}
+	if reads := atomic.LoadInt32(&src2.reads); reads != 0 {
+		t.Errorf("want no read of the source, got %d", reads)
+	}
+	if fetched, err := c2.prefetch(2); fetched || err != nil {
+		t.Errorf("prefetching a block on disk, want nothing fetched, got %v %v", fetched, err)
+	}
+	if stats := c2.Stats(); stats.DiskHits != 5 || stats.Misses != 0 {
+		t.Errorf("want 5 disk hits, got %+v", stats)
+	}
+}
@@ -0,0 +1,219 @@
+package star
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultChunkSize is the uncompressed size of chunks, unless changed by
+// Writer.SetCompression.
+const DefaultChunkSize = 1 << 20
+
+// ChunkTable locates the chunks of a compressed payload. Each chunk is
+// compressed independently, so reading any byte range of the file only
+// decompresses the chunks covering it.
+type ChunkTable struct {
+	// Compression algorithm, see RegisterCompression.
+	Compression string
+	// Uncompressed size of every chunk but the last.
+	ChunkSize uint32
+	// Offsets of chunks relative to Info.Offset, followed by the end of the
+	// last chunk, so there is one more offset than chunks.
+	Offsets []uint64
+}
+
+// StoredSize returns the size of the compressed payload.
+func (t *ChunkTable) StoredSize() uint64 {
+	if len(t.Offsets) == 0 {
+		return 0
+	}
+	return t.Offsets[len(t.Offsets)-1]
+}
+
+// Compressor compresses and decompresses chunks, appending the result to dst.
+type Compressor interface {
+	Compress(dst, src []byte) ([]byte, error)
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		"gzip": gzipCompressor{},
+		"zstd": &zstdCompressor{},
+	}
+)
+
+// RegisterCompression makes algorithm available to Writer and Reader.
+func RegisterCompression(algorithm string, c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[algorithm] = c
+}
+
+func compressor(algorithm string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", algorithm)
+	}
+	return c, nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, zr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), zr.Close()
+}
+
+// zstdCompressor shares one encoder and decoder, whose EncodeAll and
+// DecodeAll are safe for concurrent use.
+type zstdCompressor struct {
+	once    sync.Once
+	enc     *zstd.Encoder
+	dec     *zstd.Decoder
+	initErr error
+}
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		z.enc, z.initErr = zstd.NewWriter(nil)
+		if z.initErr != nil {
+			return
+		}
+		z.dec, z.initErr = zstd.NewReader(nil)
+	})
+	return z.initErr
+}
+
+func (z *zstdCompressor) Compress(dst, src []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.enc.EncodeAll(src, dst), nil
+}
+
+func (z *zstdCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.dec.DecodeAll(src, dst)
+}
+
+// chunkReaderAt reads a compressed payload, keeping the last decompressed
+// chunk for sequential reads.
+type chunkReaderAt struct {
+	r     io.ReaderAt
+	start int64
+	size  int64
+	table *ChunkTable
+	c     Compressor
+
+	mu      sync.Mutex
+	cached  int
+	chunk   []byte
+	compBuf []byte
+}
+
+func newChunkReaderAt(r io.ReaderAt, fi *Info) (*chunkReaderAt, error) {
+	c, err := compressor(fi.Chunks.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q, %w", fi.Name, err)
+	}
+	cr := &chunkReaderAt{
+		r:      r,
+		start:  int64(fi.Offset),
+		size:   int64(fi.Size),
+		table:  fi.Chunks,
+		c:      c,
+		cached: -1,
+	}
+	return cr, nil
+}
+
+func (r *chunkReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off > r.size {
+		return 0, fmt.Errorf("ReaderAt want off within [0, %d], got %d", r.size, off)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for n < len(p) && off < r.size {
+		idx := int(off / int64(r.table.ChunkSize))
+		chunk, err := r.loadChunk(idx)
+		if err != nil {
+			return n, err
+		}
+		nn := copy(p[n:], chunk[off-int64(idx)*int64(r.table.ChunkSize):])
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *chunkReaderAt) loadChunk(idx int) ([]byte, error) {
+	if idx == r.cached {
+		return r.chunk, nil
+	}
+	offsets := r.table.Offsets
+	if idx+1 >= len(offsets) {
+		return nil, fmt.Errorf("chunk %d beyond chunk table of %d chunks", idx, len(offsets)-1)
+	}
+
+	clen := int(offsets[idx+1] - offsets[idx])
+	if cap(r.compBuf) < clen {
+		r.compBuf = make([]byte, clen)
+	}
+	comp := r.compBuf[:clen]
+	n, err := r.r.ReadAt(comp, r.start+int64(offsets[idx]))
+	if err != nil && !(err == io.EOF && n == clen) {
+		return nil, fmt.Errorf("reading chunk %d, read %d bytes, err %w", idx, n, err)
+	}
+
+	r.cached = -1
+	r.chunk, err = r.c.Decompress(r.chunk[:0], comp)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing chunk %d, %w", idx, err)
+	}
+	// Every chunk but the last is ChunkSize long, so ReadAt, copying from
+	// the chunk the offset is in, always makes progress.
+	want := r.size - int64(idx)*int64(r.table.ChunkSize)
+	if want > int64(r.table.ChunkSize) {
+		want = int64(r.table.ChunkSize)
+	}
+	if int64(len(r.chunk)) != want {
+		return nil, fmt.Errorf("decompressing chunk %d, want %d bytes, got %d bytes", idx, want, len(r.chunk))
+	}
+	r.cached = idx
+	return r.chunk, nil
+}
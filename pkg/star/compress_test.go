@@ -0,0 +1,172 @@
+package star
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sequix/star/pkg/encoding"
+	"github.com/sequix/star/pkg/fs"
+)
+
+// chunkedInfo returns the info of a file of size bytes, compressed with zstd
+// in chunks of chunkSize, and the star file holding it at offset 0.
+func chunkedInfo(t *testing.T, chunks []string, size uint64, chunkSize uint32) (*Info, []byte) {
+	t.Helper()
+	c, err := compressor("zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		data  []byte
+		table = &ChunkTable{Compression: "zstd", ChunkSize: chunkSize, Offsets: []uint64{0}}
+	)
+	for _, chunk := range chunks {
+		if data, err = c.Compress(data, []byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		table.Offsets = append(table.Offsets, uint64(len(data)))
+	}
+	info := &Info{
+		FileInfo: &fs.FileInfo{Name: "f", Mode: 0644, Size: size},
+		Chunks:   table,
+	}
+	return info, data
+}
+
+func TestChunkReaderAt(t *testing.T) {
+	info, data := chunkedInfo(t, []string{"0123", "4567", "89"}, 10, 4)
+	cr, err := newChunkReaderAt(bytes.NewReader(data), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		off  int64
+		n    int
+		want string
+		err  error
+	}{
+		{0, 10, "0123456789", nil},
+		{3, 3, "345", nil},
+		{7, 5, "789", io.EOF},
+		{10, 1, "", io.EOF},
+	} {
+		p := make([]byte, tc.n)
+		n, err := cr.ReadAt(p, tc.off)
+		if string(p[:n]) != tc.want || err != tc.err {
+			t.Errorf("ReadAt(%d bytes, %d), want %q %v, got %q %v", tc.n, tc.off, tc.want, tc.err, p[:n], err)
+		}
+	}
+}
+
+func TestChunkReaderAtCorrupted(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		chunks []string
+	}{
+		{"short", []string{"01", "4567", "89"}},
+		{"empty", []string{"", "4567", "89"}},
+		{"long", []string{"0123", "4567", "89ab"}},
+		{"lastempty", []string{"0123", "4567", ""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info, data := chunkedInfo(t, tc.chunks, 10, 4)
+			cr, err := newChunkReaderAt(bytes.NewReader(data), info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := make([]byte, 10)
+			if n, err := cr.ReadAt(p, 0); err == nil || err == io.EOF {
+				t.Errorf("want error, got %d bytes, %v", n, err)
+			}
+		})
+	}
+
+	t.Run("garbage", func(t *testing.T) {
+		info, data := chunkedInfo(t, []string{"0123", "4567", "89"}, 10, 4)
+		for i := range data {
+			data[i] ^= 0xff
+		}
+		cr, err := newChunkReaderAt(bytes.NewReader(data), info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := cr.ReadAt(make([]byte, 10), 0); err == nil || err == io.EOF {
+			t.Errorf("want error, got %d bytes, %v", n, err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		info, data := chunkedInfo(t, []string{"0123", "4567", "89"}, 10, 4)
+		cr, err := newChunkReaderAt(bytes.NewReader(data[:len(data)-1]), info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cr.ReadAt(make([]byte, 2), 8); err == nil || err == io.EOF {
+			t.Errorf("want error, got %v", err)
+		}
+	})
+}
+
+func TestChunkTableCorrupted(t *testing.T) {
+	// chunksExt returns a file with a chunk table extension of count chunks,
+	// followed by lengths.
+	chunksExt := func(size uint64, count uint32, lengths ...uint32) []byte {
+		f := &Info{FileInfo: &fs.FileInfo{Name: "f", Mode: 0644, Size: size}}
+		dst := marshalInfoTo(nil, f)
+		// Replace the extension count, no extension for a plain file.
+		dst = encoding.PutUint16(dst[:len(dst)-2], 1)
+		dst, lenAt := putInfoExtHeader(dst, infoExtChunks)
+		dst = encoding.PutStr(dst, "zstd")
+		dst = encoding.PutUint32(dst, 4)
+		dst = encoding.PutUint32(dst, count)
+		for _, l := range lengths {
+			dst = encoding.PutUint32(dst, l)
+		}
+		putInfoExtLength(dst, lenAt)
+		return dst
+	}
+
+	if _, got, err := unmarshalInfoFrom(chunksExt(10, 3, 5, 5, 5), LatestVersion); err != nil {
+		t.Fatal(err)
+	} else if want := []uint64{0, 5, 10, 15}; len(got.Chunks.Offsets) != len(want) || got.Chunks.StoredSize() != 15 {
+		t.Fatalf("want offsets %v, got %v", want, got.Chunks.Offsets)
+	}
+
+	for _, tc := range []struct {
+		name string
+		src  []byte
+	}{
+		{"fewer", chunksExt(10, 2, 5, 5)},
+		{"more", chunksExt(10, 4, 5, 5, 5, 5)},
+		{"huge", chunksExt(0xffffffff*4, 0xffffffff, 5)},
+		{"wrapping", chunksExt(0, 0xffffffff)},
+		{"truncated", chunksExt(10, 3, 5, 5)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := unmarshalInfoFrom(tc.src, LatestVersion); err == nil {
+				t.Errorf("want error")
+			}
+		})
+	}
+}
+
+func TestPayloadBeyondInfos(t *testing.T) {
+	files := []testFile{{FileInfo: fs.FileInfo{Name: "f", Mode: 0644}, data: strings.Repeat("x", 100)}}
+	data := writeTestStar(t, files, nil)
+	sr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Size of the only info, after its name, linkname and offset.
+	at := sr.infoOffset + 4 + 1 + 4 + 8
+	for _, size := range []uint64{sr.infoOffset, 1 << 63, 1<<64 - 1} {
+		corrupted := append([]byte(nil), data...)
+		encoding.PutUint64(corrupted[:at], size)
+		if _, err := NewReader(bytes.NewReader(corrupted)); err == nil {
+			t.Errorf("size %d, want error", size)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package star
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultDigestAlgorithm is the algorithm of digests computed by Writer,
+// unless changed by Writer.SetDigestAlgorithm.
+const DefaultDigestAlgorithm = "sha256"
+
+var (
+	ErrNoDigest       = errors.New("star: no digest")
+	ErrDigestMismatch = errors.New("star: digest mismatch")
+)
+
+var (
+	digestersMu sync.RWMutex
+	digesters   = map[string]func() hash.Hash{
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+)
+
+// RegisterDigestAlgorithm makes algorithm available to Writer and to readers
+// verifying digests.
+func RegisterDigestAlgorithm(algorithm string, newHash func() hash.Hash) {
+	digestersMu.Lock()
+	defer digestersMu.Unlock()
+	digesters[algorithm] = newHash
+}
+
+func digester(algorithm string) (func() hash.Hash, error) {
+	digestersMu.RLock()
+	defer digestersMu.RUnlock()
+	newHash, ok := digesters[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown digest algorithm %q", algorithm)
+	}
+	return newHash, nil
+}
+
+// formatDigest formats the sum of h as "<algorithm>:<hex>".
+func formatDigest(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// newDigestHash returns the hash to verify digest with.
+func newDigestHash(digest string) (string, hash.Hash, error) {
+	i := strings.IndexByte(digest, ':')
+	if i < 0 {
+		return "", nil, fmt.Errorf("malformed digest %q", digest)
+	}
+	newHash, err := digester(digest[:i])
+	if err != nil {
+		return "", nil, err
+	}
+	return digest[:i], newHash(), nil
+}
+
+// verifyingReader fails at EOF if the content read does not match digest.
+type verifyingReader struct {
+	r         io.Reader
+	name      string
+	digest    string
+	algorithm string
+	h         hash.Hash
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if got := formatDigest(v.algorithm, v.h); got != v.digest {
+			return n, fmt.Errorf("%w of %q, want %s, got %s", ErrDigestMismatch, v.name, v.digest, got)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,108 @@
+package star
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+func TestVerifiedReaderFor(t *testing.T) {
+	data := writeTestStar(t, testFiles(), nil)
+	sr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vr, err := sr.VerifiedReaderFor("etc/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(vr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the content, leaving the index as is.
+	i := bytes.Index(data, []byte("127.0.0.1 localhost"))
+	if i < 0 {
+		t.Fatal("content of etc/hosts not found")
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[i] = '8'
+	sr, err = NewReader(bytes.NewReader(corrupted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vr, err = sr.VerifiedReaderFor("etc/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(vr); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("want %v, got %v", ErrDigestMismatch, err)
+	}
+
+	sr, err = NewReader(bytes.NewReader(writeTestStar(t, testFiles(), func(w *Writer) { w.SetDigestAlgorithm("") })))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.VerifiedReaderFor("etc/hosts"); !errors.Is(err, ErrNoDigest) {
+		t.Errorf("without digests, want %v, got %v", ErrNoDigest, err)
+	}
+}
+
+func TestNewDigestHashCorrupted(t *testing.T) {
+	for _, digest := range []string{
+		"",
+		"sha256",
+		"deadbeef",
+		":deadbeef",
+		"md5:d41d8cd98f00b204e9800998ecf8427e",
+		"SHA256:deadbeef",
+	} {
+		if _, _, err := newDigestHash(digest); err == nil {
+			t.Errorf("digest %q, want an error", digest)
+		}
+	}
+	algorithm, h, err := newDigestHash("sha512:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != "sha512" || h.Size() != 64 {
+		t.Errorf("want sha512, got %s of %d bytes", algorithm, h.Size())
+	}
+}
+
+func TestWriterDigestOfBegunFileOnly(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, fi := range []*fs.FileInfo{
+		{Name: "empty", Mode: 0644},
+		{Name: "dir", Mode: os.ModeDir | 0755},
+	} {
+		if err := w.WriteHeader(fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A stray write after a directory writes nothing, nor hashes anything.
+	if _, err := w.Write([]byte("x")); !errors.Is(err, ErrWriteTooLong) {
+		t.Errorf("writing to a dir, want %v, got %v", ErrWriteTooLong, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range sr.ListFiles() {
+		switch {
+		case info.Name == "empty" && len(info.Digest) == 0:
+			t.Errorf("empty file without digest")
+		case info.Name == "dir" && len(info.Digest) > 0:
+			t.Errorf("dir with digest %q", info.Digest)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package star
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/sequix/star/pkg/encoding"
+)
+
+const (
+	Magic    = 0xab72617473cd
+	Version1 = 0x00
+	// Version2 appends extension records to each info, see infoExtXattrs,
+	// which may compress payloads, see infoExtChunks. The lengths move from
+	// the header to a footer, so a star file could be written to a plain
+	// io.Writer, and the footer tells where the payloads of hot files end.
+	// The header reserves space for later fields readers could ignore.
+	Version2 = 0x01
+	// LatestVersion is the version written by Writer.
+	LatestVersion = Version2
+)
+
+// headerReservedLen is the length of the zeros following the version since
+// Version2, which pad the header to 32 bytes.
+const headerReservedLen = 23
+
+// footerLen is the length of the footer since Version2.
+const footerLen = 8 + 8 + 8 + 8
+
+// layout locates the infos of a star file, given the version byte is read.
+type layout func(sr *Reader, src []byte) error
+
+// layouts by version, every version ever written must stay here, so star
+// files written by older stars stay readable.
+var layouts = map[byte]layout{
+	Version1: readHeaderLengths,
+	Version2: readFooter,
+}
+
+// layoutFor returns the layout of version, or an error telling whether
+// version is newer than this star or not a version at all.
+func layoutFor(version byte) (layout, error) {
+	if l, ok := layouts[version]; ok {
+		return l, nil
+	}
+	if version > LatestVersion {
+		return nil, fmt.Errorf("star version %d is newer than the latest supported %d, upgrade star to read it",
+			version+1, LatestVersion+1)
+	}
+	return nil, fmt.Errorf("unknown star version %#x", version)
+}
+
+// Version1:
+//
+// <magic>(8) <version>(1) <payload-length>(8) <info-length>(4) <padding>(4)
+// <payload1> <payload2> ... <payloadN>
+// <Info1> <Info2> .... <InfoN>
+//
+// The payload length counts the padding, so infos are at 21+payload-length.
+// Infos have no extension records.
+func readHeaderLengths(sr *Reader, src []byte) error {
+	n, err := sr.r.ReadAt(src[:8], 9)
+	if err != nil {
+		return fmt.Errorf("reading payload length, read %d bytes, err %w", n, err)
+	}
+	_, payloadLen, err := encoding.GetUint64(src[:8])
+	if err != nil {
+		return fmt.Errorf("parsing payload length, %w", err)
+	}
+
+	n, err = sr.r.ReadAt(src[:4], 17)
+	if err != nil {
+		return fmt.Errorf("reading info length, read %d bytes, err %w", n, err)
+	}
+	_, infoLen, err := encoding.GetUint32(src[:4])
+	if err != nil {
+		return fmt.Errorf("parsing info length, %w", err)
+	}
+
+	if payloadLen > math.MaxInt64-21 {
+		return fmt.Errorf("payload length %d too large", payloadLen)
+	}
+	sr.infoOffset = 21 + payloadLen
+	sr.infoLen = uint64(infoLen)
+	if sr.size >= 0 && sr.infoOffset+sr.infoLen > uint64(sr.size) {
+		return fmt.Errorf("infos at %d of %d bytes beyond the end at %d", sr.infoOffset, sr.infoLen, sr.size)
+	}
+	return nil
+}
+
+// Since Version2:
+//
+// <magic>(8) <version>(1) <reserved>(23)
+// <payload1> <payload2> ... <payloadN>
+// <Info1> <Info2> .... <InfoN>
+// <info-offset>(8) <info-length>(8) <hot-end>(8) <magic>(8)
+//
+// Payloads of hot files are before hot-end, see Writer.MarkHotEnd, which is
+// 0 if there are no hot files.
+func readFooter(sr *Reader, src []byte) error {
+	if sr.size < 0 {
+		return fmt.Errorf("star version %d needs the size of the file to locate its footer", sr.version+1)
+	}
+	if sr.size < 9+headerReservedLen+footerLen {
+		return fmt.Errorf("star file too short, %d bytes", sr.size)
+	}
+
+	footer := encoding.Resize(src, int(footerLen))
+	n, err := sr.r.ReadAt(footer, sr.size-footerLen)
+	if err != nil && !(err == io.EOF && n == len(footer)) {
+		return fmt.Errorf("reading footer, read %d bytes, err %w", n, err)
+	}
+	footer, sr.infoOffset, _ = encoding.GetUint64(footer)
+	footer, sr.infoLen, _ = encoding.GetUint64(footer)
+	footer, sr.hotEnd, _ = encoding.GetUint64(footer)
+	_, magic, _ := encoding.GetUint64(footer)
+	if magic != Magic {
+		return fmt.Errorf("parsing footer magic, want %x, got %x", Magic, magic)
+	}
+	// Compared separately, as the sum of corrupted ones could overflow.
+	end := uint64(sr.size - footerLen)
+	if sr.infoLen > end || sr.infoOffset > end-sr.infoLen {
+		return fmt.Errorf("infos at %d of %d bytes beyond footer at %d", sr.infoOffset, sr.infoLen, end)
+	}
+	if sr.hotEnd > sr.infoOffset {
+		return fmt.Errorf("hot files end at %d beyond infos at %d", sr.hotEnd, sr.infoOffset)
+	}
+	return nil
+}
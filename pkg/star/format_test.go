@@ -0,0 +1,139 @@
+package star
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sequix/star/pkg/encoding"
+	"github.com/sequix/star/pkg/fs"
+)
+
+// rewriteVersion returns the star file data, written by Writer, in the
+// layout of Version1, which holds no extension records.
+func rewriteVersion(t *testing.T, data []byte) []byte {
+	t.Helper()
+	sr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const headerLen = 9 + headerReservedLen
+	payloads := data[headerLen:sr.infoOffset]
+
+	var infos []byte
+	for _, info := range sr.ListFiles() {
+		info.Offset = info.Offset - headerLen + 21 + 4
+		n := len(infos)
+		infos = marshalInfoTo(infos, info)
+		if _, exts, _ := encoding.GetUint16(infos[len(infos)-2:]); exts != 0 {
+			t.Fatalf("info of %q has extensions, not in version 1", info.Name)
+		}
+		infos = infos[:len(infos)-2]
+		if _, _, err := unmarshalInfoFrom(infos[n:], Version1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := encoding.PutUint64(nil, Magic)
+	out = append(out, Version1)
+	out = encoding.PutUint64(out, 4+uint64(len(payloads)))
+	out = encoding.PutUint32(out, uint32(len(infos)))
+	out = append(out, 0, 0, 0, 0)
+	out = append(out, payloads...)
+	return append(out, infos...)
+}
+
+// writeVersion1Star returns a star file of Version1, of the test files it
+// could hold, which have no kinds, xattrs, digests or compression.
+func writeVersion1Star(t *testing.T) ([]byte, []testFile) {
+	t.Helper()
+	var plain []testFile
+	for _, tf := range testFiles() {
+		if tf.Kind == fs.KindNormal && len(tf.Xattrs) == 0 {
+			plain = append(plain, tf)
+		}
+	}
+	data := writeTestStar(t, plain, func(w *Writer) { w.SetDigestAlgorithm("") })
+	return rewriteVersion(t, data), plain
+}
+
+func TestReadVersions(t *testing.T) {
+	v1, plain := writeVersion1Star(t)
+	latest := writeTestStar(t, testFiles(), func(w *Writer) { w.SetCompression("zstd", testChunkSize) })
+
+	for _, tc := range []struct {
+		version byte
+		data    []byte
+		files   []testFile
+	}{
+		{Version1, v1, plain},
+		{LatestVersion, latest, testFiles()},
+	} {
+		sr := checkTestStar(t, tc.data, tc.files)
+		if sr.Version() != tc.version {
+			t.Errorf("want version %d, got %d", tc.version+1, sr.Version()+1)
+		}
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	v1, _ := writeVersion1Star(t)
+	for _, data := range [][]byte{v1, writeTestStar(t, testFiles(), nil)} {
+		for n := 0; n < len(data); n++ {
+			if _, err := NewReader(bytes.NewReader(data[:n])); err == nil {
+				t.Errorf("version %d truncated to %d of %d bytes, want error", data[8]+1, n, len(data))
+			}
+		}
+	}
+}
+
+func TestReadFooterCorrupted(t *testing.T) {
+	data := writeTestStar(t, testFiles(), nil)
+	sr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	footerAt := len(data) - 32
+
+	for _, tc := range []struct {
+		name                        string
+		infoOffset, infoLen, hotEnd uint64
+	}{
+		{"overflow", 1<<64 - 1, 2, 0},
+		{"overflowlen", 2, 1<<64 - 1, 0},
+		{"beyond", sr.infoOffset, sr.infoLen + 1, 0},
+		{"hotend", sr.infoOffset, sr.infoLen, sr.infoOffset + 1},
+		{"zeros", 0, 0, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			corrupted := append([]byte(nil), data...)
+			footer := encoding.PutUint64(corrupted[:footerAt], tc.infoOffset)
+			footer = encoding.PutUint64(footer, tc.infoLen)
+			encoding.PutUint64(footer, tc.hotEnd)
+			if _, err := NewReader(bytes.NewReader(corrupted)); err == nil {
+				t.Errorf("want error")
+			}
+		})
+	}
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, err := NewReader(bytes.NewReader(corrupted)); err == nil {
+		t.Errorf("corrupted footer magic, want error")
+	}
+	corrupted = append([]byte(nil), data...)
+	corrupted[8] = LatestVersion + 1
+	if _, err := NewReader(bytes.NewReader(corrupted)); err == nil {
+		t.Errorf("newer version, want error")
+	}
+}
+
+func TestReadHeaderLengthsCorrupted(t *testing.T) {
+	data, _ := writeVersion1Star(t)
+	for _, payloadLen := range []uint64{1<<64 - 1, 1<<64 - 21, uint64(len(data))} {
+		corrupted := append([]byte(nil), data...)
+		encoding.PutUint64(corrupted[:9], payloadLen)
+		if _, err := NewReader(bytes.NewReader(corrupted)); err == nil {
+			t.Errorf("payload length %d, want error", payloadLen)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package star
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultHTTPRetries is the number of retries of a failed request.
+	DefaultHTTPRetries = 3
+	// DefaultHTTPBackoff is the wait before the first retry, doubled after
+	// each retry.
+	DefaultHTTPBackoff = 200 * time.Millisecond
+)
+
+// DefaultHTTPClient is the client of NewHTTPReaderAt. Unlike
+// http.DefaultClient, it gives up on servers which do not answer, instead of
+// hanging reads of mounts. Bodies are not bounded by a timeout, as large
+// ranges over slow links take long.
+var DefaultHTTPClient = &http.Client{Transport: DefaultHTTPTransport}
+
+// DefaultHTTPTransport is the transport of DefaultHTTPClient.
+var DefaultHTTPTransport http.RoundTripper = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   16,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// errNoRange is returned if the server ignores Range requests.
+var errNoRange = errors.New("server does not support range requests")
+
+// HTTPReaderAt reads a remote star file with HTTP Range requests, so a star
+// file could be listed, extracted or mounted without downloading all of it.
+type HTTPReaderAt struct {
+	url    string
+	client *http.Client
+	size   int64
+	// ETag of the file when its size was discovered. Reads fail instead of
+	// mixing two versions of the file if it changes.
+	etag    string
+	retries int
+	backoff time.Duration
+}
+
+// NewHTTPReaderAt discovers the size of the file at url, and returns an
+// HTTPReaderAt reading it with DefaultHTTPClient.
+func NewHTTPReaderAt(url string) (*HTTPReaderAt, error) {
+	return NewHTTPReaderAtClient(url, DefaultHTTPClient)
+}
+
+// NewHTTPReaderAtClient is like NewHTTPReaderAt, with the client given.
+func NewHTTPReaderAtClient(url string, client *http.Client) (*HTTPReaderAt, error) {
+	r := &HTTPReaderAt{
+		url:     url,
+		client:  client,
+		retries: DefaultHTTPRetries,
+		backoff: DefaultHTTPBackoff,
+	}
+	if err := r.discover(); err != nil {
+		return nil, fmt.Errorf("discovering size of %q, %w", url, err)
+	}
+	return r, nil
+}
+
+// SetRetries changes the number of retries and the wait before the first
+// retry of failed requests.
+func (r *HTTPReaderAt) SetRetries(retries int, backoff time.Duration) {
+	r.retries, r.backoff = retries, backoff
+}
+
+// Size returns the size of the remote file.
+func (r *HTTPReaderAt) Size() int64 {
+	return r.size
+}
+
+// ETag returns the strong ETag of the remote file, empty if it has none.
+func (r *HTTPReaderAt) ETag() string {
+	return r.etag
+}
+
+// discover asks for the first byte, the Content-Range of the response tells
+// both the size and that ranges are supported.
+func (r *HTTPReaderAt) discover() error {
+	return r.retry(func() error {
+		req, err := http.NewRequest(http.MethodGet, r.url, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+			// An empty file, not a star file, but let NewReader tell.
+			r.size = 0
+		case resp.StatusCode == http.StatusPartialContent:
+			_, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+			if err != nil {
+				return permanent(err)
+			}
+			r.size = size
+		case resp.StatusCode == http.StatusOK:
+			return permanent(errNoRange)
+		default:
+			return statusError(resp)
+		}
+		// Weak ETags never match If-Match.
+		if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+			r.etag = etag
+		}
+		return nil
+	})
+}
+
+// ReadAt reads len(p) bytes at off with one Range request, retrying transient
+// failures.
+func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("ReaderAt want off >= 0, got %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if off+int64(len(p)) > r.size {
+		p = p[:r.size-off]
+		err = io.EOF
+	}
+	if len(p) == 0 {
+		return 0, err
+	}
+
+	var n int
+	rerr := r.retry(func() error {
+		var rerr error
+		n, rerr = r.readRange(p, off)
+		return rerr
+	})
+	if rerr != nil {
+		return n, fmt.Errorf("reading %q [%d, %d), %w", r.url, off, off+int64(len(p)), rerr)
+	}
+	return n, err
+}
+
+func (r *HTTPReaderAt) readRange(p []byte, off int64) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return 0, permanent(err)
+	}
+	end := off + int64(len(p)) - 1
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end))
+	if len(r.etag) > 0 {
+		req.Header.Set("If-Match", r.etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return 0, permanent(errNoRange)
+	case http.StatusPreconditionFailed:
+		return 0, permanent(fmt.Errorf("remote file changed, etag was %s", r.etag))
+	default:
+		return 0, statusError(resp)
+	}
+
+	start, last, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return 0, permanent(err)
+	}
+	if start != off || last != end {
+		return 0, permanent(fmt.Errorf("asked bytes %d-%d, got %d-%d", off, end, start, last))
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err != nil {
+		// A truncated body is worth another try.
+		return n, fmt.Errorf("reading response body, read %d bytes, err %w", n, err)
+	}
+	return n, nil
+}
+
+// retry calls do until it succeeds, it returns a permanent error, or the
+// retries run out.
+func (r *HTTPReaderAt) retry(do func() error) error {
+	backoff := r.backoff
+	for i := 0; ; i++ {
+		err := do()
+		if err == nil {
+			return nil
+		}
+		var perr *permanentError
+		if errors.As(err, &perr) {
+			return perr.err
+		}
+		if i >= r.retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// permanentError is a failure of a request not worth retrying.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// statusError returns the error of an unexpected status, which is retried if
+// it is a server error or too many requests.
+func statusError(resp *http.Response) error {
+	err := fmt.Errorf("unexpected status %s", resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return permanent(err)
+}
+
+// parseContentRange parses "bytes <first>-<last>/<size>".
+func parseContentRange(s string) (first, last, size int64, err error) {
+	spec := strings.TrimPrefix(s, "bytes ")
+	slash := strings.IndexByte(spec, '/')
+	dash := strings.IndexByte(spec, '-')
+	if len(spec) == len(s) || slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, fmt.Errorf("parsing Content-Range %q", s)
+	}
+	if first, err = strconv.ParseInt(spec[:dash], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("parsing Content-Range %q, %w", s, err)
+	}
+	if last, err = strconv.ParseInt(spec[dash+1:slash], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("parsing Content-Range %q, %w", s, err)
+	}
+	if size, err = strconv.ParseInt(spec[slash+1:], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("parsing Content-Range %q, size unknown, %w", s, err)
+	}
+	return first, last, size, nil
+}
@@ -0,0 +1,154 @@
+package star
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer serves content with Range requests and an ETag, failing the
+// next failures requests with 503.
+type rangeServer struct {
+	mu       sync.Mutex
+	content  []byte
+	etag     string
+	failures int
+	noRange  bool
+	ranges   []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	content, etag := s.content, s.etag
+	s.ranges = append(s.ranges, req.Header.Get("Range"))
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mu.Unlock()
+
+	switch {
+	case fail:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	case s.noRange:
+		w.Write(content)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+}
+
+func (s *rangeServer) set(content, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content, s.etag = []byte(content), etag
+}
+
+func (s *rangeServer) fail(failures int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = failures
+}
+
+func newTestHTTPReaderAt(t *testing.T, s *rangeServer) *HTTPReaderAt {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	hr, err := NewHTTPReaderAtClient(ts.URL, ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr.SetRetries(2, time.Millisecond)
+	return hr
+}
+
+func TestHTTPReaderAtRange(t *testing.T) {
+	s := &rangeServer{}
+	s.set("0123456789", `"v1"`)
+	hr := newTestHTTPReaderAt(t, s)
+	if hr.Size() != 10 || hr.ETag() != `"v1"` {
+		t.Fatalf("want size 10 etag \"v1\", got %d %s", hr.Size(), hr.ETag())
+	}
+
+	for _, tc := range []struct {
+		off  int64
+		n    int
+		want string
+		err  error
+	}{
+		{2, 3, "234", nil},
+		{8, 4, "89", io.EOF},
+		{10, 1, "", io.EOF},
+	} {
+		p := make([]byte, tc.n)
+		n, err := hr.ReadAt(p, tc.off)
+		if string(p[:n]) != tc.want || err != tc.err {
+			t.Errorf("ReadAt(%d bytes, %d), want %q %v, got %q %v", tc.n, tc.off, tc.want, tc.err, p[:n], err)
+		}
+	}
+	// The discovery, and one request per read within the file.
+	if want := []string{"bytes=0-0", "bytes=2-4", "bytes=8-9"}; fmt.Sprint(s.ranges) != fmt.Sprint(want) {
+		t.Errorf("want ranges %q, got %q", want, s.ranges)
+	}
+}
+
+func TestHTTPReaderAtETagChange(t *testing.T) {
+	s := &rangeServer{}
+	s.set("0123456789", `"v1"`)
+	hr := newTestHTTPReaderAt(t, s)
+
+	s.set("abcdefghij", `"v2"`)
+	n, err := hr.ReadAt(make([]byte, 4), 0)
+	if err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("want error of a changed file, got %d bytes, %v", n, err)
+	}
+	// Not retried, the file stays changed.
+	if len(s.ranges) != 2 {
+		t.Errorf("want 2 requests, got %q", s.ranges)
+	}
+}
+
+func TestHTTPReaderAtRetry(t *testing.T) {
+	s := &rangeServer{}
+	s.set("0123456789", `"v1"`)
+	hr := newTestHTTPReaderAt(t, s)
+
+	s.fail(2)
+	p := make([]byte, 3)
+	if n, err := hr.ReadAt(p, 0); err != nil || string(p[:n]) != "012" {
+		t.Errorf("want \"012\", got %q %v", p[:n], err)
+	}
+
+	s.fail(3)
+	if _, err := hr.ReadAt(p, 0); err == nil {
+		t.Errorf("retries run out, want error")
+	}
+}
+
+func TestHTTPReaderAtNoRange(t *testing.T) {
+	s := &rangeServer{noRange: true}
+	s.set("0123456789", "")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	if _, err := NewHTTPReaderAtClient(ts.URL, ts.Client()); err == nil {
+		t.Errorf("server ignoring ranges, want error")
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	if first, last, size, err := parseContentRange("bytes 2-4/10"); err != nil || first != 2 || last != 4 || size != 10 {
+		t.Errorf("want 2 4 10, got %d %d %d %v", first, last, size, err)
+	}
+	for _, s := range []string{"", "bytes", "bytes 2-4", "bytes 4/10", "bytes 2-4/*", "bytes a-4/10", "items 2-4/10"} {
+		if _, _, _, err := parseContentRange(s); err == nil {
+			t.Errorf("parsing %q, want error", s)
+		}
+	}
+}
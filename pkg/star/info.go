@@ -1,8 +1,10 @@
 package star
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/sequix/star/pkg/encoding"
@@ -12,8 +14,37 @@ import (
 type Info struct {
 	*fs.FileInfo
 	Offset uint64
+	// Digest of the payload as "<algorithm>:<hex>", empty if not computed.
+	Digest string
+	// Chunks of the payload if compressed, nil if stored as is.
+	Chunks *ChunkTable
 }
 
+// StoredSize returns the size of the payload in the star file, which differs
+// from Size if compressed.
+func (f *Info) StoredSize() uint64 {
+	if f.Chunks != nil {
+		return f.Chunks.StoredSize()
+	}
+	return f.Size
+}
+
+// Since Version2, each info is followed by extension records,
+// <ext-count>(2) <ext-tag>(1) <ext-length>(4) <ext-data> ...
+// Readers skip records with unknown tags, so new records could be added
+// without breaking readers of the same version.
+const (
+	// <xattr-count>(4) <key1> <value1> ... <keyN> <valueN>
+	infoExtXattrs = 0x01
+	// <kind>(1), absent for fs.KindNormal
+	infoExtKind = 0x02
+	// <digest>, absent if not computed
+	infoExtDigest = 0x03
+	// <compression> <chunk-size>(4) <chunk-count>(4) <chunk-length1>(4) ...,
+	// absent if stored as is
+	infoExtChunks = 0x04
+)
+
 func marshalInfoTo(dst []byte, f *Info) []byte {
 	dst = encoding.PutStr(dst, f.Name)
 	dst = encoding.PutStr(dst, f.Linkname)
@@ -27,10 +58,81 @@ func marshalInfoTo(dst []byte, f *Info) []byte {
 	dst = encoding.PutUint32(dst, uint32(f.Mode))
 	dst = encoding.PutUint32(dst, f.Major)
 	dst = encoding.PutUint32(dst, f.Minor)
+	return marshalInfoExtsTo(dst, f)
+}
+
+func marshalInfoExtsTo(dst []byte, f *Info) []byte {
+	var exts uint16
+	if len(f.Xattrs) > 0 {
+		exts++
+	}
+	if f.Kind != fs.KindNormal {
+		exts++
+	}
+	if len(f.Digest) > 0 {
+		exts++
+	}
+	if f.Chunks != nil {
+		exts++
+	}
+	dst = encoding.PutUint16(dst, exts)
+
+	var lenAt int
+
+	if len(f.Xattrs) > 0 {
+		keys := make([]string, 0, len(f.Xattrs))
+		for key := range f.Xattrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		dst, lenAt = putInfoExtHeader(dst, infoExtXattrs)
+		dst = encoding.PutUint32(dst, uint32(len(keys)))
+		for _, key := range keys {
+			dst = encoding.PutStr(dst, key)
+			dst = encoding.PutStr(dst, f.Xattrs[key])
+		}
+		putInfoExtLength(dst, lenAt)
+	}
+
+	if f.Kind != fs.KindNormal {
+		dst, lenAt = putInfoExtHeader(dst, infoExtKind)
+		dst = append(dst, byte(f.Kind))
+		putInfoExtLength(dst, lenAt)
+	}
+
+	if len(f.Digest) > 0 {
+		dst, lenAt = putInfoExtHeader(dst, infoExtDigest)
+		dst = encoding.PutStr(dst, f.Digest)
+		putInfoExtLength(dst, lenAt)
+	}
+
+	if t := f.Chunks; t != nil {
+		dst, lenAt = putInfoExtHeader(dst, infoExtChunks)
+		dst = encoding.PutStr(dst, t.Compression)
+		dst = encoding.PutUint32(dst, t.ChunkSize)
+		dst = encoding.PutUint32(dst, uint32(len(t.Offsets)-1))
+		for i := 1; i < len(t.Offsets); i++ {
+			dst = encoding.PutUint32(dst, uint32(t.Offsets[i]-t.Offsets[i-1]))
+		}
+		putInfoExtLength(dst, lenAt)
+	}
 	return dst
 }
 
-func unmarshalInfoFrom(src []byte) ([]byte, *Info, error) {
+// putInfoExtHeader puts the tag and a placeholder length of an extension
+// record, putInfoExtLength fills the length after the data is put.
+func putInfoExtHeader(dst []byte, tag byte) ([]byte, int) {
+	dst = append(dst, tag)
+	dst = encoding.PutUint32(dst, 0)
+	return dst, len(dst)
+}
+
+func putInfoExtLength(dst []byte, lenAt int) {
+	binary.BigEndian.PutUint32(dst[lenAt-4:lenAt], uint32(len(dst)-lenAt))
+}
+
+func unmarshalInfoFrom(src []byte, version byte) ([]byte, *Info, error) {
 	var (
 		u64 uint64
 		u32 uint32
@@ -79,13 +181,13 @@ func unmarshalInfoFrom(src []byte) ([]byte, *Info, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("unmarshalInfoFrom getting atime, %w", err)
 	}
-	f.Ctime = time.Unix(0, int64(u64))
+	f.Atime = time.Unix(0, int64(u64))
 
 	src, u64, err = encoding.GetUint64(src)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unmarshalInfoFrom getting ctime, %w", err)
 	}
-	f.Atime = time.Unix(0, int64(u64))
+	f.Ctime = time.Unix(0, int64(u64))
 	
 	src, u32, err = encoding.GetUint32(src)
 	if err != nil {
@@ -102,5 +204,138 @@ func unmarshalInfoFrom(src []byte) ([]byte, *Info, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("unmarshalInfoFrom getting minor, %w", err)
 	}
+
+	if version >= Version2 {
+		src, err = unmarshalInfoExtsFrom(src, f)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	return src, f, nil
-}
\ No newline at end of file
+}
+
+func unmarshalInfoExtsFrom(src []byte, f *Info) ([]byte, error) {
+	var (
+		exts uint16
+		tag  byte
+		n    uint32
+		err  error
+	)
+	src, exts, err = encoding.GetUint16(src)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalInfoFrom getting extension count, %w", err)
+	}
+
+	for i := uint16(0); i < exts; i++ {
+		if len(src) < 1 {
+			return nil, fmt.Errorf("unmarshalInfoFrom getting extension tag, need 1 byte, got 0")
+		}
+		tag, src = src[0], src[1:]
+
+		src, n, err = encoding.GetUint32(src)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshalInfoFrom getting extension length, %w", err)
+		}
+		if uint32(len(src)) < n {
+			return nil, fmt.Errorf("unmarshalInfoFrom getting extension %#x, need %d bytes, got %d bytes", tag, n, len(src))
+		}
+		data := src[:n]
+		src = src[n:]
+
+		switch tag {
+		case infoExtXattrs:
+			err = unmarshalInfoXattrs(data, f)
+		case infoExtKind:
+			if len(data) < 1 {
+				err = fmt.Errorf("unmarshalInfoFrom getting kind, need 1 byte, got 0")
+			} else {
+				f.Kind = fs.Kind(data[0])
+			}
+		case infoExtDigest:
+			_, f.Digest, err = encoding.GetStr(data)
+			if err != nil {
+				err = fmt.Errorf("unmarshalInfoFrom getting digest, %w", err)
+			}
+		case infoExtChunks:
+			err = unmarshalInfoChunks(data, f)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+func unmarshalInfoXattrs(src []byte, f *Info) error {
+	var (
+		n          uint32
+		key, value string
+		err        error
+	)
+	src, n, err = encoding.GetUint32(src)
+	if err != nil {
+		return fmt.Errorf("unmarshalInfoFrom getting xattr count, %w", err)
+	}
+
+	// Each xattr takes the lengths of its key and value at least, so a count
+	// from a corrupted file does not size the map.
+	if uint64(n) > uint64(len(src))/8 {
+		return fmt.Errorf("unmarshalInfoFrom getting xattrs, %d xattrs in %d bytes", n, len(src))
+	}
+	f.Xattrs = make(map[string]string, n)
+	for i := uint32(0); i < n; i++ {
+		src, key, err = encoding.GetStr(src)
+		if err != nil {
+			return fmt.Errorf("unmarshalInfoFrom getting xattr key, %w", err)
+		}
+		src, value, err = encoding.GetStr(src)
+		if err != nil {
+			return fmt.Errorf("unmarshalInfoFrom getting xattr %q, %w", key, err)
+		}
+		f.Xattrs[key] = value
+	}
+	return nil
+}
+func unmarshalInfoChunks(src []byte, f *Info) error {
+	var (
+		n, clen uint32
+		err     error
+		t       = &ChunkTable{}
+	)
+	src, t.Compression, err = encoding.GetStr(src)
+	if err != nil {
+		return fmt.Errorf("unmarshalInfoFrom getting compression, %w", err)
+	}
+	src, t.ChunkSize, err = encoding.GetUint32(src)
+	if err != nil {
+		return fmt.Errorf("unmarshalInfoFrom getting chunk size, %w", err)
+	}
+	if t.ChunkSize == 0 {
+		return fmt.Errorf("unmarshalInfoFrom getting chunk size, got 0")
+	}
+	src, n, err = encoding.GetUint32(src)
+	if err != nil {
+		return fmt.Errorf("unmarshalInfoFrom getting chunk count, %w", err)
+	}
+
+	// The count must be that of the chunks of Size, and fit in the extension,
+	// so a count from a corrupted file does not size the table.
+	if want := (f.Size + uint64(t.ChunkSize) - 1) / uint64(t.ChunkSize); uint64(n) != want {
+		return fmt.Errorf("unmarshalInfoFrom getting chunk count, want %d chunks of %d bytes, got %d", want, f.Size, n)
+	}
+	if uint64(n) > uint64(len(src))/4 {
+		return fmt.Errorf("unmarshalInfoFrom getting chunk lengths, %d chunks in %d bytes", n, len(src))
+	}
+
+	// Offsets are summed from lengths, so they increase and do not overflow.
+	t.Offsets = make([]uint64, 1, uint64(n)+1)
+	for i := uint32(0); i < n; i++ {
+		src, clen, err = encoding.GetUint32(src)
+		if err != nil {
+			return fmt.Errorf("unmarshalInfoFrom getting chunk length, %w", err)
+		}
+		t.Offsets = append(t.Offsets, t.Offsets[i]+uint64(clen))
+	}
+	f.Chunks = t
+	return nil
+}
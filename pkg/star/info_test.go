@@ -0,0 +1,93 @@
+package star
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+func TestInfoTimes(t *testing.T) {
+	f := &Info{FileInfo: &fs.FileInfo{
+		Name:  "f",
+		Mode:  0644,
+		Mtime: time.Unix(1, 0),
+		Atime: time.Unix(2, 0),
+		Ctime: time.Unix(3, 0),
+	}}
+	rest, got, err := unmarshalInfoFrom(marshalInfoTo(nil, f), LatestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) > 0 {
+		t.Errorf("%d bytes left", len(rest))
+	}
+	if !got.Mtime.Equal(f.Mtime) || !got.Atime.Equal(f.Atime) || !got.Ctime.Equal(f.Ctime) {
+		t.Errorf("want mtime %s atime %s ctime %s, got %s %s %s",
+			f.Mtime, f.Atime, f.Ctime, got.Mtime, got.Atime, got.Ctime)
+	}
+}
+
+func TestInfoXattrs(t *testing.T) {
+	f := &Info{FileInfo: &fs.FileInfo{
+		Name: "f",
+		Mode: 0644,
+		Xattrs: map[string]string{
+			"user.a":              "1",
+			"security.capability": "\x00\x01",
+			"user.empty":          "",
+		},
+	}}
+	_, got, err := unmarshalInfoFrom(marshalInfoTo(nil, f), LatestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Xattrs) != len(f.Xattrs) {
+		t.Fatalf("want %d xattrs, got %v", len(f.Xattrs), got.Xattrs)
+	}
+	for key, value := range f.Xattrs {
+		if got.Xattrs[key] != value {
+			t.Errorf("xattr %q, want %q, got %q", key, value, got.Xattrs[key])
+		}
+	}
+}
+
+func TestInfoXattrsCorrupted(t *testing.T) {
+	for _, data := range [][]byte{
+		// A count far beyond the data.
+		{0xff, 0xff, 0xff, 0xff},
+		{0x00, 0x00, 0x00, 0x02, 0, 0, 0, 0, 0, 0, 0, 0},
+		// A key longer than the data.
+		{0x00, 0x00, 0x00, 0x01, 0, 0, 0, 9, 0, 0, 0, 0},
+	} {
+		if err := unmarshalInfoXattrs(data, &Info{FileInfo: &fs.FileInfo{}}); err == nil {
+			t.Errorf("unmarshalInfoXattrs(%x), want error", data)
+		}
+	}
+}
+
+// TestInfoTruncated checks infos cut anywhere fail to parse, not panic.
+func TestInfoTruncated(t *testing.T) {
+	f := &Info{
+		FileInfo: &fs.FileInfo{
+			Name:     "f",
+			Linkname: "l",
+			Size:     3 << 20,
+			Mode:     0644,
+			Kind:     fs.KindHardlink,
+			Xattrs:   map[string]string{"user.a": "1"},
+		},
+		Digest: "sha256:00",
+		Chunks: &ChunkTable{
+			Compression: "zstd",
+			ChunkSize:   1 << 20,
+			Offsets:     []uint64{0, 10, 20, 30},
+		},
+	}
+	data := marshalInfoTo(nil, f)
+	for i := 0; i < len(data); i++ {
+		if _, _, err := unmarshalInfoFrom(data[:i], LatestVersion); err == nil {
+			t.Errorf("info cut at %d of %d bytes, want error", i, len(data))
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package star
+
+import (
+	"io"
+	iofs "io/fs"
+	"path"
+	"syscall"
+)
+
+var (
+	_ iofs.FS         = (*Reader)(nil)
+	_ iofs.StatFS     = (*Reader)(nil)
+	_ iofs.ReadDirFS  = (*Reader)(nil)
+	_ iofs.ReadFileFS = (*Reader)(nil)
+
+	_ iofs.FS         = (*LayeredReader)(nil)
+	_ iofs.StatFS     = (*LayeredReader)(nil)
+	_ iofs.ReadDirFS  = (*LayeredReader)(nil)
+	_ iofs.ReadFileFS = (*LayeredReader)(nil)
+
+	_ io.ReaderAt      = (*file)(nil)
+	_ io.Seeker        = (*file)(nil)
+	_ iofs.ReadDirFile = (*dir)(nil)
+)
+
+// Open opens the file name for reading, following symlinks, so the star file
+// could be used as an fs.FS. Regular files implement io.ReaderAt and
+// io.Seeker, directories implement fs.ReadDirFile.
+func (t *dirTree) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+	nd, err := t.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fi := newFileInfo(path.Base(name), nd.info)
+	if nd.children != nil {
+		entries, err := t.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dir{fi: fi, entries: entries}, nil
+	}
+
+	ra, err := nd.layer.readerAtOf(nd.info)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{fi: fi, ra: ra}, nil
+}
+
+// ReadFile reads the whole content of the file name, following symlinks.
+func (t *dirTree) ReadFile(name string) ([]byte, error) {
+	f, err := t.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ff, ok := f.(*file)
+	if !ok {
+		return nil, &iofs.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	data := make([]byte, ff.fi.info.Size)
+	if _, err := io.ReadFull(ff, data); err != nil {
+		return nil, &iofs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// file is a file opened by Reader.Open other than a directory.
+type file struct {
+	fi     *fileInfo
+	ra     io.ReaderAt
+	offset int64
+	closed bool
+}
+
+func (f *file) Stat() (iofs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, iofs.ErrClosed
+	}
+	if off < 0 {
+		return 0, &iofs.PathError{Op: "readat", Path: f.fi.name, Err: iofs.ErrInvalid}
+	}
+	size := int64(f.fi.info.Size)
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		err = io.EOF
+	}
+	n, rerr := f.ra.ReadAt(p, off)
+	if rerr != nil && !(rerr == io.EOF && n == len(p)) {
+		return n, rerr
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, iofs.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.fi.info.Size)
+	default:
+		return 0, &iofs.PathError{Op: "seek", Path: f.fi.name, Err: iofs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &iofs.PathError{Op: "seek", Path: f.fi.name, Err: iofs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return iofs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// dir is a directory opened by Reader.Open.
+type dir struct {
+	fi      *fileInfo
+	entries []iofs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (iofs.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.fi.name, Err: syscall.EISDIR}
+}
+
+// ReadDir returns the next n entries, or all remaining entries if n <= 0,
+// see fs.ReadDirFile.
+func (d *dir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
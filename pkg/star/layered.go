@@ -0,0 +1,191 @@
+package star
+
+import (
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+var (
+	_ View = (*Reader)(nil)
+	_ View = (*LayeredReader)(nil)
+)
+
+// View is the directory tree of a Reader, or of a LayeredReader merging
+// several of them, which could be mounted.
+type View interface {
+	ListFiles() []*Info
+	ReaderAtFor(name string) (io.ReaderAt, error)
+	view() *dirTree
+}
+
+// LayeredReader presents the merged rootfs of a stack of star files, like
+// overlayfs does for the layers of a container image. Entries of upper layers
+// replace those of lower layers, whiteouts hide lower entries, and opaque
+// directories hide the lower content of the directory.
+type LayeredReader struct {
+	// From the lowest layer to the uppermost.
+	layers []*Reader
+	dirTree
+}
+
+// NewLayeredReader merges layers, given from the lowest layer to the
+// uppermost, the order of layers in an OCI image manifest.
+func NewLayeredReader(layers ...*Reader) *LayeredReader {
+	lr := &LayeredReader{
+		layers:  layers,
+		dirTree: newDirTree(),
+	}
+	for _, layer := range layers {
+		lr.merge(layer, lr.indexes)
+		lr.indexes += layer.indexes
+	}
+	return lr
+}
+
+// merge puts the entries of layer over the tree, numbering them after base,
+// so each node of each layer has an index of its own.
+func (lr *LayeredReader) merge(layer *Reader, base int) {
+	// Whiteouts only apply to lower layers, so they go first.
+	for _, info := range layer.infos {
+		if info.Kind != fs.KindWhiteout && info.Kind != fs.KindOpaque {
+			continue
+		}
+		nd, ok := lr.nodes[CleanName(info.Name)]
+		if !ok {
+			continue
+		}
+		if info.Kind == fs.KindWhiteout && nd.parent != nil {
+			lr.remove(nd.parent, path.Base(nd.name))
+		} else if info.Kind == fs.KindOpaque && nd.children != nil {
+			for _, child := range nd.children {
+				lr.drop(child)
+			}
+			nd.children = map[string]*node{}
+		}
+	}
+
+	if layer.root.layer != nil {
+		lr.root.info, lr.root.layer = layer.root.info, layer
+	}
+
+	// Nodes of the tree by the nodes of layer they are merged from, so hard
+	// links point to the targets in their own layer, whatever upper layers
+	// do to the names of the targets.
+	merged := map[*node]*node{}
+	var mergeChildren func(dn, ldn *node)
+	mergeChildren = func(dn, ldn *node) {
+		for name, lcn := range ldn.children {
+			cn, ok := dn.children[name]
+			// Directories are merged, an implied one does not replace the
+			// info of the directory it is merged with.
+			if ok && cn.children != nil && lcn.children != nil {
+				if lcn.layer != nil {
+					cn.info, cn.index, cn.layer = lcn.info, base+lcn.index, lcn.layer
+				}
+				mergeChildren(cn, lcn)
+				continue
+			}
+
+			cn = &node{
+				name:   lcn.name,
+				info:   lcn.info,
+				index:  base + lcn.index,
+				layer:  lcn.layer,
+				parent: dn,
+			}
+			if lcn.children != nil {
+				cn.children = map[string]*node{}
+			}
+			lr.replace(dn, name, cn)
+			merged[lcn] = cn
+			if cn.children != nil {
+				mergeChildren(cn, lcn)
+			}
+		}
+	}
+	mergeChildren(lr.root, layer.root)
+
+	for lcn, cn := range merged {
+		if lcn.target == nil {
+			continue
+		}
+		// A target replaced later in its own layer is no longer merged.
+		if cn.target = merged[lcn.target]; cn.target == nil {
+			cn.target = lcn.target
+		}
+	}
+}
+
+// Layers returns the layers merged, from the lowest to the uppermost.
+func (lr *LayeredReader) Layers() []*Reader {
+	return lr.layers
+}
+
+// ListFiles returns the infos of the entries of the merged tree, layer by
+// layer, in the order they are stored in each layer.
+func (lr *LayeredReader) ListFiles() []*Info {
+	var infos []*Info
+	for _, layer := range lr.layers {
+		for _, info := range layer.infos {
+			if nd, ok := lr.nodes[CleanName(info.Name)]; ok && nd.info == info {
+				infos = append(infos, info)
+			}
+		}
+	}
+	return infos
+}
+
+func (lr *LayeredReader) ListNames() []string {
+	infos := lr.ListFiles()
+	names := make([]string, 0, len(infos))
+	for _, ifo := range infos {
+		names = append(names, ifo.Name)
+	}
+	return names
+}
+
+// LayerOf returns the layer holding the file name, not following symlinks.
+func (lr *LayeredReader) LayerOf(name string) (*Reader, error) {
+	nd, ok := lr.nodes[CleanName(name)]
+	if !ok || nd.layer == nil {
+		return nil, fmt.Errorf("not found info with name %q", name)
+	}
+	return nd.layer, nil
+}
+
+// ReaderAtFor is like Reader.ReaderAtFor, reading from the layer holding the
+// file name.
+func (lr *LayeredReader) ReaderAtFor(name string) (io.ReaderAt, error) {
+	layer, err := lr.LayerOf(name)
+	if err != nil {
+		return nil, err
+	}
+	return layer.ReaderAtFor(name)
+}
+
+// ReaderFor is like Reader.ReaderFor, reading from the layer holding the
+// file name.
+func (lr *LayeredReader) ReaderFor(name string) (io.Reader, error) {
+	layer, err := lr.LayerOf(name)
+	if err != nil {
+		return nil, err
+	}
+	return layer.ReaderFor(name)
+}
+
+// VerifiedReaderFor is like Reader.VerifiedReaderFor, reading from the layer
+// holding the file name.
+func (lr *LayeredReader) VerifiedReaderFor(name string) (io.Reader, error) {
+	layer, err := lr.LayerOf(name)
+	if err != nil {
+		return nil, err
+	}
+	return layer.VerifiedReaderFor(name)
+}
+
+func (lr *LayeredReader) Mount(mountpoint string) error {
+	return Mount(mountpoint, lr)
+}
@@ -0,0 +1,96 @@
+package star
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// newTestLayers returns the layers of files, from the lowest one.
+func newTestLayers(t *testing.T, layers ...[]testFile) *LayeredReader {
+	t.Helper()
+	var readers []*Reader
+	for _, files := range layers {
+		sr, err := NewReader(bytes.NewReader(writeTestStar(t, files, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, sr)
+	}
+	return NewLayeredReader(readers...)
+}
+
+func TestLayeredHardlinks(t *testing.T) {
+	file := func(name, data string) testFile {
+		return testFile{FileInfo: fs.FileInfo{Name: name, Mode: 0644}, data: data}
+	}
+	hardlink := func(name, target string) testFile {
+		return testFile{FileInfo: fs.FileInfo{Name: name, Mode: 0644, Kind: fs.KindHardlink, Linkname: target}}
+	}
+	lr := newTestLayers(t,
+		[]testFile{file("a", "lower a"), hardlink("l", "a"), hardlink("ll", "l")},
+		// Replaces a, and links to the new a.
+		[]testFile{file("a", "upper a"), hardlink("u", "a")},
+	)
+	lower, upper := lr.Layers()[0], lr.Layers()[1]
+
+	for _, tc := range []struct {
+		name, target string
+		layer        *Reader
+		data         string
+	}{
+		{"l", "a", lower, "lower a"},
+		{"ll", "a", lower, "lower a"},
+		{"u", "a", upper, "upper a"},
+		{"a", "a", upper, "upper a"},
+	} {
+		nd := lr.nodes[tc.name]
+		target := lr.hardlinkTarget(nd)
+		if target == nil {
+			t.Errorf("target of %q missing", tc.name)
+			continue
+		}
+		if target.name != tc.target || target.layer != tc.layer {
+			t.Errorf("target of %q, want %q of layer %p, got %q of layer %p", tc.name, tc.target, tc.layer, target.name, target.layer)
+		}
+		if data, err := lr.ReadFile(tc.name); err != nil || string(data) != tc.data {
+			t.Errorf("content of %q, want %q, got %q %v", tc.name, tc.data, data, err)
+		}
+	}
+	// The lower a is no longer merged, but its hard links still share it.
+	if lr.hardlinkTarget(lr.nodes["l"]) != lr.hardlinkTarget(lr.nodes["ll"]) {
+		t.Errorf("want l and ll sharing their target")
+	}
+	if lr.hardlinkTarget(lr.nodes["u"]) != lr.nodes["a"] {
+		t.Errorf("want u sharing the merged a")
+	}
+}
+
+func TestLayeredFS(t *testing.T) {
+	lower := testFiles()
+	upper := []testFile{
+		{FileInfo: fs.FileInfo{Name: "etc/hosts", Mode: 0600}, data: "upper hosts"},
+		{FileInfo: fs.FileInfo{Name: "etc/big", Kind: fs.KindWhiteout}},
+		{FileInfo: fs.FileInfo{Name: "dev", Kind: fs.KindOpaque}},
+		{FileInfo: fs.FileInfo{Name: "dev/zero", Mode: 0644}},
+		{FileInfo: fs.FileInfo{Name: "usr/bin/env", Mode: 0755}, data: "#!env"},
+	}
+	lr := newTestLayers(t, lower, upper)
+	if err := fstest.TestFS(lr, "etc/hosts", "etc/hard", "etc/link", "etc/big.copy", "dev/zero", "bin/su", "usr/bin/env"); err != nil {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"etc/big", "dev/null"} {
+		if _, err := lr.Lstat(name); err == nil {
+			t.Errorf("want %q hidden", name)
+		}
+	}
+	if data, err := lr.ReadFile("etc/link"); err != nil || string(data) != "upper hosts" {
+		t.Errorf("want etc/link to the upper etc/hosts, got %q %v", data, err)
+	}
+	if data, err := lr.ReadFile("etc/hard"); err != nil || string(data) != "127.0.0.1 localhost\n" {
+		t.Errorf("want etc/hard to the lower etc/hosts, got %q %v", data, err)
+	}
+}
@@ -1,5 +1,309 @@
 package star
 
-func Mount(mntpoint string, sr *Reader) error {
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// Mount mounts v read-only at mntpoint and serves it until unmounted, v is a
+// Reader or a LayeredReader.
+func Mount(mntpoint string, v View) error {
+	server, err := NewMountServer(mntpoint, v, nil)
+	if err != nil {
+		return err
+	}
+	server.Wait()
 	return nil
-}
\ No newline at end of file
+}
+
+// MountOptions configure a mount, nil mounts read-only showing the ids of
+// the star files.
+type MountOptions struct {
+	// Upper mounts writable if not empty. Like overlayfs, files created or
+	// modified go to the directory Upper, files modified are copied up
+	// first, and files deleted are recorded as whiteouts in the OCI
+	// convention, see fs.ParseWhiteout, so Upper is a layer to put over the
+	// star files, see fs.NewUpperReader. Files not modified are still read
+	// from the star files.
+	Upper string
+	// UIDMap and GIDMap map the ids of the star files to those shown by the
+	// mount and given to files copied up, see fs.IDMap.
+	UIDMap, GIDMap *fs.IDMap
+}
+
+// NewMountServer mounts v at mntpoint, and returns the server once it is
+// serving requests. Call Unmount on the server to tear the mount down.
+func NewMountServer(mntpoint string, v View, opts *MountOptions) (*fuse.Server, error) {
+	if opts == nil {
+		opts = &MountOptions{}
+	}
+
+	var (
+		root    fusefs.InodeEmbedder
+		timeout = time.Hour
+		err     error
+	)
+	if len(opts.Upper) > 0 {
+		if err := os.MkdirAll(opts.Upper, 0755); err != nil {
+			return nil, fmt.Errorf("creating upper dir %q, %w", opts.Upper, err)
+		}
+		if root, err = newUpperRoot(v.view(), opts); err != nil {
+			return nil, err
+		}
+		// Files change, so the kernel only caches them shortly.
+		timeout = time.Second
+	} else {
+		root = newMountRoot(v.view(), opts)
+	}
+
+	server, err := fusefs.Mount(mntpoint, root, &fusefs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName: "star",
+			Name:   "star",
+		},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mounting at %q, %w", mntpoint, err)
+	}
+	return server, nil
+}
+
+// mountNode serves one entry of the star file. Directories never listed in
+// the star file get a synthesized info.
+type mountNode struct {
+	fusefs.Inode
+	// Reader holding info, nil if info is implied.
+	layer *Reader
+	info  *Info
+	nlink uint32
+}
+
+// mountRoot is the root directory of the mount, it populates the tree.
+type mountRoot struct {
+	mountNode
+	tree *dirTree
+	opts *MountOptions
+}
+
+var (
+	_ = (fusefs.NodeOnAdder)((*mountRoot)(nil))
+	_ = (fusefs.NodeGetattrer)((*mountNode)(nil))
+	_ = (fusefs.NodeOpener)((*mountNode)(nil))
+	_ = (fusefs.NodeReader)((*mountNode)(nil))
+	_ = (fusefs.NodeReadlinker)((*mountNode)(nil))
+	_ = (fusefs.NodeGetxattrer)((*mountNode)(nil))
+	_ = (fusefs.NodeListxattrer)((*mountNode)(nil))
+)
+
+func newMountRoot(tree *dirTree, opts *MountOptions) *mountRoot {
+	return &mountRoot{
+		mountNode: mountNode{
+			info:  impliedDirInfo("."),
+			nlink: 2,
+		},
+		tree: tree,
+		opts: opts,
+	}
+}
+
+func (n *mountNode) root() *mountRoot {
+	return n.Root().Operations().(*mountRoot)
+}
+
+// OnAdd builds the whole tree with persistent inodes once the root is
+// attached. Inode numbers follow the order of infos in the star files, so
+// they are stable across mounts of the same files.
+func (r *mountRoot) OnAdd(ctx context.Context) {
+	var (
+		n      = &r.mountNode
+		tree   = r.tree
+		inodes = map[*node]*mountNode{tree.root: n}
+	)
+	n.info, n.layer = tree.root.info, tree.root.layer
+
+	inodeFor := func(nd *node) *mountNode {
+		if mn, ok := inodes[nd]; ok {
+			return mn
+		}
+		mn := &mountNode{layer: nd.layer, info: nd.info, nlink: 1}
+		if nd.children != nil {
+			mn.nlink = 2
+		}
+		attr := fusefs.StableAttr{Mode: unixMode(nd.info.Mode) & syscall.S_IFMT, Ino: uint64(nd.index) + 2}
+		n.NewPersistentInode(ctx, mn, attr)
+		inodes[nd] = mn
+		return mn
+	}
+
+	var addChildren func(dn *node)
+	addChildren = func(dn *node) {
+		dmn := inodes[dn]
+		for base, cn := range dn.children {
+			// Hard links share the inode of their target.
+			if cn.info.Kind == fs.KindHardlink {
+				if target := tree.hardlinkTarget(cn); target != nil {
+					tmn := inodeFor(target)
+					tmn.nlink++
+					dmn.AddChild(base, tmn.EmbeddedInode(), true)
+					continue
+				}
+			}
+
+			cmn := inodeFor(cn)
+			dmn.AddChild(base, cmn.EmbeddedInode(), true)
+			if cn.children != nil {
+				dmn.nlink++
+				addChildren(cn)
+			}
+		}
+	}
+	addChildren(tree.root)
+}
+
+func (n *mountNode) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillAttr(&out.Attr, n.info, n.nlink, n.root().opts)
+	return fusefs.OK
+}
+
+// fillAttr fills out with the attributes of info, with ids mapped by opts.
+func fillAttr(out *fuse.Attr, info *Info, nlink uint32, opts *MountOptions) {
+	out.Mode = unixMode(info.Mode)
+	out.Size = info.Size
+	out.Blocks = (info.Size + 511) / 512
+	out.Nlink = nlink
+	out.Uid = opts.UIDMap.Map(info.Uid)
+	out.Gid = opts.GIDMap.Map(info.Gid)
+	out.SetTimes(&info.Atime, &info.Mtime, &info.Ctime)
+	if info.Mode&os.ModeDevice != 0 {
+		out.Rdev = uint32(mkdev(info.Major, info.Minor))
+	}
+	if info.Mode&os.ModeSymlink != 0 {
+		out.Size = uint64(len(info.Linkname))
+	}
+}
+
+func (n *mountNode) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if !n.info.Mode.IsRegular() || n.layer == nil {
+		return nil, 0, syscall.EINVAL
+	}
+	ra, err := n.layer.readerAtFor(n.info)
+	if err != nil {
+		return nil, 0, syscall.ENOENT
+	}
+	return &mountHandle{ra: ra}, fuse.FOPEN_KEEP_CACHE, fusefs.OK
+}
+
+func (n *mountNode) Read(ctx context.Context, f fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	fh, ok := f.(*mountHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return fh.Read(ctx, dest, off)
+}
+
+func (n *mountNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.info.Mode&os.ModeSymlink == 0 {
+		return nil, syscall.EINVAL
+	}
+	return []byte(n.info.Linkname), fusefs.OK
+}
+
+func (n *mountNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	value, ok := n.info.Xattrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), fusefs.OK
+}
+
+func (n *mountNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	keys := make([]string, 0, len(n.info.Xattrs))
+	for key := range n.info.Xattrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var list []byte
+	for _, key := range keys {
+		list = append(list, key...)
+		list = append(list, 0)
+	}
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), fusefs.OK
+}
+
+// mountHandle is the handle of an opened regular file.
+type mountHandle struct {
+	ra io.ReaderAt
+}
+
+func (h *mountHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	nr, err := h.ra.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:nr]), fusefs.OK
+}
+
+// unixMode converts an os.FileMode to the mode used by stat(2).
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch mode & os.ModeType {
+	case os.ModeDir:
+		m |= syscall.S_IFDIR
+	case os.ModeSymlink:
+		m |= syscall.S_IFLNK
+	case os.ModeNamedPipe:
+		m |= syscall.S_IFIFO
+	case os.ModeSocket:
+		m |= syscall.S_IFSOCK
+	case os.ModeDevice:
+		m |= syscall.S_IFBLK
+	case os.ModeDevice | os.ModeCharDevice:
+		m |= syscall.S_IFCHR
+	default:
+		m |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	// Star files written from tars by older stars keep these bits as in tar
+	// headers, see fs.TarReader.
+	m |= uint32(mode & (syscall.S_ISUID | syscall.S_ISGID | syscall.S_ISVTX))
+	return m
+}
+
+// mkdev encodes major and minor the way linux does, see fs.mkdev.
+func mkdev(major, minor uint32) uint64 {
+	dev := (uint64(major) & 0x00000fff) << 8
+	dev |= (uint64(major) & 0xfffff000) << 32
+	dev |= (uint64(minor) & 0x000000ff) << 0
+	dev |= (uint64(minor) & 0xffffff00) << 12
+	return dev
+}
@@ -0,0 +1,81 @@
+package star
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+func TestUnixMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode os.FileMode
+		want uint32
+	}{
+		{0644, syscall.S_IFREG | 0644},
+		{os.ModeDir | 0755, syscall.S_IFDIR | 0755},
+		{os.ModeSetuid | 0755, syscall.S_IFREG | syscall.S_ISUID | 0755},
+		{os.ModeDir | os.ModeSticky | 0777, syscall.S_IFDIR | syscall.S_ISVTX | 0777},
+		{os.ModeDevice | os.ModeCharDevice | 0666, syscall.S_IFCHR | 0666},
+		// As kept from tar headers by older stars.
+		{04755, syscall.S_IFREG | syscall.S_ISUID | 0755},
+		{02755, syscall.S_IFREG | syscall.S_ISGID | 0755},
+		{os.ModeDir | 01777, syscall.S_IFDIR | syscall.S_ISVTX | 0777},
+	} {
+		if got := unixMode(tc.mode); got != tc.want {
+			t.Errorf("unixMode(%v), want %o, got %o", tc.mode, tc.want, got)
+		}
+	}
+}
+
+func TestMountReplacedHardlinkTarget(t *testing.T) {
+	files := []testFile{
+		{FileInfo: fs.FileInfo{Name: "a", Mode: 0644}, data: "old a"},
+		{FileInfo: fs.FileInfo{Name: "h", Mode: 0644, Kind: fs.KindHardlink, Linkname: "a"}},
+		// Replaces a, h still links to the old one.
+		{FileInfo: fs.FileInfo{Name: "a", Mode: 0644}, data: "the new a"},
+	}
+	sr, err := NewReader(bytes.NewReader(writeTestStar(t, files, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"h": "old a", "a": "the new a"} {
+		target := sr.hardlinkTarget(sr.nodes[name])
+		mn := &mountNode{layer: target.layer, info: target.info}
+		fh, _, errno := mn.Open(context.Background(), syscall.O_RDONLY)
+		if errno != fusefs.OK {
+			t.Fatalf("opening %q, %v", name, errno)
+		}
+		buf := make([]byte, 64)
+		rr, errno := mn.Read(context.Background(), fh, buf, 0)
+		if errno != fusefs.OK {
+			t.Fatalf("reading %q, %v", name, errno)
+		}
+		got, _ := rr.Bytes(buf)
+		if string(got) != want {
+			t.Errorf("content of %q, want %q, got %q", name, want, got)
+		}
+	}
+
+	// Each info reads its own content, as export and extract do.
+	for i, fi := range sr.ListFiles() {
+		if fi.Kind == fs.KindHardlink {
+			continue
+		}
+		fr, err := sr.ReaderForInfo(fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(fr)
+		if err != nil || string(got) != files[i].data {
+			t.Errorf("content of info %d, want %q, got %q %v", i, files[i].data, got, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package star
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// prefetchYield is how long prefetching waits for on-demand reads of the
+	// source to finish before checking again.
+	prefetchYield = 10 * time.Millisecond
+	// prefetchMaxBackoff is the longest wait before retrying a block failed
+	// to prefetch, e.g. while the network is down.
+	prefetchMaxBackoff = time.Minute
+)
+
+// Prefetcher reads blocks of a CachedReaderAt in the background, so later
+// reads are served from the cache. Prioritized ranges are read first, then
+// the rest of the source, unless only the prioritized ranges are asked for.
+// Blocks already in the disk cache are skipped, so a prefetch interrupted
+// resumes where it stopped, given the same disk cache.
+type Prefetcher struct {
+	c        *CachedReaderAt
+	rate     int64
+	all      bool
+	priority []int64
+
+	mu     sync.Mutex
+	status PrefetchStatus
+}
+
+// PrefetchStatus is the progress of a Prefetcher.
+type PrefetchStatus struct {
+	// Blocks and bytes to prefetch.
+	Blocks int64 `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+	// Blocks and bytes cached so far, read by prefetching or not.
+	DoneBlocks int64 `json:"done_blocks"`
+	DoneBytes  int64 `json:"done_bytes"`
+	// Bytes read from the source by prefetching.
+	FetchedBytes int64 `json:"fetched_bytes"`
+	Done         bool  `json:"done"`
+	// Last error, prefetching retries failed blocks.
+	Err string `json:"error,omitempty"`
+}
+
+// NewPrefetcher returns a Prefetcher of all blocks of c.
+func NewPrefetcher(c *CachedReaderAt) *Prefetcher {
+	return &Prefetcher{c: c, all: true}
+}
+
+// SetRate limits prefetching to rate bytes per second, 0 for no limit.
+func (p *Prefetcher) SetRate(rate int64) {
+	p.rate = rate
+}
+
+// SetAll tells whether the blocks not prioritized are prefetched, which they
+// are by default.
+func (p *Prefetcher) SetAll(all bool) {
+	p.all = all
+}
+
+// Prioritize prefetches the blocks covering length bytes at off first, in the
+// order prioritized.
+func (p *Prefetcher) Prioritize(off, length int64) {
+	if length <= 0 || off >= p.c.size {
+		return
+	}
+	first := off / p.c.blockSize
+	last := (off + length - 1) / p.c.blockSize
+	for index := first; index <= last && index < p.c.numBlocks(); index++ {
+		p.priority = append(p.priority, index)
+	}
+}
+
+// Status returns the progress so far.
+func (p *Prefetcher) Status() PrefetchStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Run prefetches until all blocks are cached or ctx is done. Reads failing
+// are retried with backoff, Run only returns an error if ctx is done first.
+func (p *Prefetcher) Run(ctx context.Context) error {
+	var (
+		order = p.order()
+		start = time.Now()
+	)
+	p.mu.Lock()
+	p.status.Blocks = int64(len(order))
+	for _, index := range order {
+		p.status.Bytes += p.c.blockLen(index)
+	}
+	p.mu.Unlock()
+
+	for _, index := range order {
+		fetched, err := p.prefetch(ctx, index)
+		if err != nil {
+			return err
+		}
+
+		length := p.c.blockLen(index)
+		p.mu.Lock()
+		p.status.DoneBlocks++
+		p.status.DoneBytes += length
+		if fetched {
+			p.status.FetchedBytes += length
+		}
+		fetchedBytes := p.status.FetchedBytes
+		p.mu.Unlock()
+
+		if fetched && p.rate > 0 {
+			// Sleep until the average rate since start is within the limit.
+			due := start.Add(time.Duration(float64(fetchedBytes) / float64(p.rate) * float64(time.Second)))
+			if err := sleepUntil(ctx, due); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.status.Done = true
+	p.status.Err = ""
+	p.mu.Unlock()
+	return nil
+}
+
+// order returns the indexes of blocks to prefetch, prioritized ones first.
+func (p *Prefetcher) order() []int64 {
+	var (
+		order []int64
+		seen  = map[int64]bool{}
+	)
+	for _, index := range p.priority {
+		if !seen[index] {
+			seen[index] = true
+			order = append(order, index)
+		}
+	}
+	if p.all {
+		for index := int64(0); index < p.c.numBlocks(); index++ {
+			if !seen[index] {
+				order = append(order, index)
+			}
+		}
+	}
+	return order
+}
+
+// prefetch caches one block once no on-demand read is in flight, retrying
+// until it succeeds or ctx is done.
+func (p *Prefetcher) prefetch(ctx context.Context, index int64) (bool, error) {
+	backoff := time.Second
+	for {
+		for atomic.LoadInt32(&p.c.demand) > 0 {
+			if err := sleepUntil(ctx, time.Now().Add(prefetchYield)); err != nil {
+				return false, err
+			}
+		}
+
+		fetched, err := p.c.prefetch(index)
+		if err == nil {
+			return fetched, nil
+		}
+
+		p.mu.Lock()
+		p.status.Err = err.Error()
+		p.mu.Unlock()
+		if err := sleepUntil(ctx, time.Now().Add(backoff)); err != nil {
+			return false, err
+		}
+		if backoff *= 2; backoff > prefetchMaxBackoff {
+			backoff = prefetchMaxBackoff
+		}
+	}
+}
+
+// sleepUntil sleeps until t, or returns the error of ctx if it is done first.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
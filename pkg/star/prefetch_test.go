@@ -0,0 +1,156 @@
+package star
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingReaderAt records the offsets read of a source, failing the reads
+// if err is not nil, and blocking reads at blockOff until release is closed
+// if release is not nil.
+type recordingReaderAt struct {
+	r        *strings.Reader
+	err      error
+	blockOff int64
+	release  chan struct{}
+
+	mu   sync.Mutex
+	offs []int64
+}
+
+func (r *recordingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.offs = append(r.offs, off)
+	r.mu.Unlock()
+	if r.release != nil && off == r.blockOff {
+		<-r.release
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.r.ReadAt(p, off)
+}
+
+func (r *recordingReaderAt) reads() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64(nil), r.offs...)
+}
+
+func newTestPrefetcher(t *testing.T, src *recordingReaderAt) (*CachedReaderAt, *Prefetcher) {
+	t.Helper()
+	// 5 blocks of 4 bytes, all kept in memory.
+	c, err := NewCachedReaderAt(src, int64(len(testCacheContent)), 4, int64(len(testCacheContent)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, NewPrefetcher(c)
+}
+
+func TestPrefetcherStatus(t *testing.T) {
+	src := &recordingReaderAt{r: strings.NewReader(testCacheContent)}
+	c, p := newTestPrefetcher(t, src)
+	// Block 1 is read on demand, so it is not fetched again.
+	readCached(t, c, 4, 1)
+	p.Prioritize(8, 5)
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := PrefetchStatus{
+		Blocks:       5,
+		Bytes:        20,
+		DoneBlocks:   5,
+		DoneBytes:    20,
+		FetchedBytes: 16,
+		Done:         true,
+	}
+	if got := p.Status(); got != want {
+		t.Errorf("status, want %+v, got %+v", want, got)
+	}
+	// Prioritized blocks 2 and 3 first, then the others not cached.
+	if want, got := []int64{4, 8, 12, 0, 16}, src.reads(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reads of the source, want offsets %v, got %v", want, got)
+	}
+
+	src = &recordingReaderAt{r: strings.NewReader(testCacheContent)}
+	_, p = newTestPrefetcher(t, src)
+	p.SetAll(false)
+	p.Prioritize(18, 10)
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = PrefetchStatus{Blocks: 1, Bytes: 4, DoneBlocks: 1, DoneBytes: 4, FetchedBytes: 4, Done: true}
+	if got := p.Status(); got != want {
+		t.Errorf("prioritized only, want %+v, got %+v", want, got)
+	}
+}
+
+func TestPrefetcherYields(t *testing.T) {
+	src := &recordingReaderAt{r: strings.NewReader(testCacheContent), blockOff: 16, release: make(chan struct{})}
+	c, p := newTestPrefetcher(t, src)
+
+	// An on-demand read of the last block, in flight until released.
+	done := make(chan string)
+	go func() {
+		p := make([]byte, 4)
+		n, _ := c.ReadAt(p, 16)
+		done <- string(p[:n])
+	}()
+	for atomic.LoadInt32(&c.demand) == 0 {
+		runtime.Gosched()
+	}
+
+	ran := make(chan error)
+	go func() { ran <- p.Run(context.Background()) }()
+	time.Sleep(5 * prefetchYield)
+	if got := src.reads(); len(got) != 1 {
+		t.Errorf("on-demand read in flight, want prefetching waiting, got reads at %v", got)
+	}
+
+	close(src.release)
+	if got := <-done; got != "ghij" {
+		t.Errorf("on-demand read, want \"ghij\", got %q", got)
+	}
+	if err := <-ran; err != nil {
+		t.Fatal(err)
+	}
+	if status := p.Status(); !status.Done || status.FetchedBytes != 16 {
+		t.Errorf("want done, fetching all but the block read on demand, got %+v", status)
+	}
+}
+
+func TestPrefetcherCancel(t *testing.T) {
+	errDown := errors.New("network down")
+	src := &recordingReaderAt{r: strings.NewReader(testCacheContent), err: errDown}
+	_, p := newTestPrefetcher(t, src)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error)
+	go func() { ran <- p.Run(ctx) }()
+	// Failed reads are retried, until canceled.
+	for len(p.Status().Err) == 0 {
+		runtime.Gosched()
+	}
+	cancel()
+
+	select {
+	case err := <-ran:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled, want Run returning")
+	}
+	status := p.Status()
+	if status.Done || status.DoneBlocks != 0 || !strings.Contains(status.Err, errDown.Error()) {
+		t.Errorf("canceled before any block, want not done and the last error, got %+v", status)
+	}
+}
@@ -3,25 +3,41 @@ package star
 import (
 	"fmt"
 	"io"
+	"os"
 
 	"github.com/sequix/star/pkg/encoding"
 )
 
 type Reader struct {
 	r          io.ReaderAt
-	payloadLen uint64
-	infoLen    uint32
+	size       int64
+	version    byte
+	infoOffset uint64
+	infoLen    uint64
+	hotEnd     uint64
 	infos      []*Info
-	name2Info  map[string]*Info
+	// Directory tree of infos.
+	dirTree
+	// Trace of the files read, nil if not tracing.
+	trace *Trace
 }
 
+// NewReader reads the infos of the star file in r. Star files since Version2
+// are located by their footer, the size of r is taken from its Size or Stat
+// method, use NewReaderSize if r has neither.
 func NewReader(r io.ReaderAt) (*Reader, error) {
+	return NewReaderSize(r, sizeOf(r))
+}
+
+// NewReaderSize is like NewReader, with the size of r given. A negative size
+// means the size is unknown.
+func NewReaderSize(r io.ReaderAt, size int64) (*Reader, error) {
 	var (
 		ifo *Info
 		src = make([]byte, 0, 512)
 		sr  = &Reader{
-			r:         r,
-			name2Info: map[string]*Info{},
+			r:    r,
+			size: size,
 		}
 	)
 
@@ -34,43 +50,68 @@ func NewReader(r io.ReaderAt) (*Reader, error) {
 		return nil, fmt.Errorf("parsing star magic, want %x, got %x, err %w", Magic, magic, err)
 	}
 
-	// If need upgrade the star format version, read version flag here.
-
-	n, err = r.ReadAt(src[:8], 9)
+	n, err = r.ReadAt(src[:1], 8)
 	if err != nil {
-		return nil, fmt.Errorf("reading payload length, read %d bytes, err %w", n, err)
-	}
-	_, sr.payloadLen, err = encoding.GetUint64(src[:8])
-	if err != nil {
-		return nil, fmt.Errorf("parsing payload length, %w", err)
+		return nil, fmt.Errorf("reading star version, read %d bytes, err %w", n, err)
 	}
+	sr.version = src[:1][0]
 
-	n, err = r.ReadAt(src[:4], 17)
+	readLayout, err := layoutFor(sr.version)
 	if err != nil {
-		return nil, fmt.Errorf("reading info length, read %d bytes, err %w", n, err)
+		return nil, err
 	}
-	_, sr.infoLen, err = encoding.GetUint32(src[:4])
-	if err != nil {
-		return nil, fmt.Errorf("parsing info length, %w", err)
+	if err := readLayout(sr, src); err != nil {
+		return nil, fmt.Errorf("reading star version %d layout, %w", sr.version+1, err)
 	}
 
 	src = encoding.Resize(src, int(sr.infoLen))
-	n, err = r.ReadAt(src, int64(21+sr.payloadLen))
-	if err != nil {
+	n, err = r.ReadAt(src, int64(sr.infoOffset))
+	if err != nil && !(err == io.EOF && n == len(src)) {
 		return nil, fmt.Errorf("reading infos, reda %d bytes, err %w", n, err)
 	}
 
 	for len(src) > 0 {
-		src, ifo, err = unmarshalInfoFrom(src)
+		src, ifo, err = unmarshalInfoFrom(src, sr.version)
 		if err != nil {
 			return nil, fmt.Errorf("parsing info, %w", err)
 		}
+		// Payloads are before infos in every version.
+		if ifo.Mode.IsRegular() {
+			if stored := ifo.StoredSize(); stored > sr.infoOffset || ifo.Offset > sr.infoOffset-stored {
+				return nil, fmt.Errorf("parsing info of %q, payload [%d, +%d) beyond infos at %d", ifo.Name, ifo.Offset, stored, sr.infoOffset)
+			}
+		}
 		sr.infos = append(sr.infos, ifo)
-		sr.name2Info[ifo.Name] = ifo
 	}
+	sr.buildTree()
 	return sr, nil
 }
 
+// sizeOf returns the size of r, or -1 if unknown.
+func sizeOf(r io.ReaderAt) int64 {
+	switch rr := r.(type) {
+	case interface{ Size() int64 }:
+		return rr.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := rr.Stat(); err == nil {
+			return fi.Size()
+		}
+	}
+	return -1
+}
+
+// Version returns the format version of the star file.
+func (r *Reader) Version() byte {
+	return r.version
+}
+
+// HotEnd returns the offset the payloads of hot files end at, so fetching
+// the star file up to it gets all hot files. It is 0 if there are no hot
+// files, see Writer.MarkHotEnd.
+func (r *Reader) HotEnd() int64 {
+	return int64(r.hotEnd)
+}
+
 func (r *Reader) ListFiles() []*Info {
 	return r.infos
 }
@@ -83,11 +124,40 @@ func (r *Reader) ListNames() []string {
 	return names
 }
 
-func (r *Reader) ReaderAtFor(name string) (io.ReaderAt, error) {
-	fi, ok := r.name2Info[name]
-	if !ok || fi == nil {
+// infoFor returns the info of the file name, not following symlinks.
+func (r *Reader) infoFor(name string) (*Info, error) {
+	nd, ok := r.nodes[CleanName(name)]
+	if !ok {
 		return nil, fmt.Errorf("not found info with name %q", name)
 	}
+	return nd.info, nil
+}
+
+// ReaderAtFor returns an io.ReaderAt over the content of the file. Reads of
+// compressed files only decompress the chunks covering them.
+func (r *Reader) ReaderAtFor(name string) (io.ReaderAt, error) {
+	fi, err := r.infoFor(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.readerAtFor(fi)
+}
+
+// readerAtFor is like ReaderAtFor, reading the content of fi, an info of r,
+// not that of the file named as fi, which is another one if the name is
+// stored again later.
+func (r *Reader) readerAtFor(fi *Info) (io.ReaderAt, error) {
+	ra, err := r.readerAtOf(fi)
+	if err != nil || r.trace == nil {
+		return ra, err
+	}
+	return &tracingReaderAt{r: ra, trace: r.trace, tf: r.trace.touch(fi.Name)}, nil
+}
+
+func (r *Reader) readerAtOf(fi *Info) (io.ReaderAt, error) {
+	if fi.Chunks != nil {
+		return newChunkReaderAt(r.r, fi)
+	}
 	fr := &fileReaderAt{
 		r:     r.r,
 		start: int64(fi.Offset),
@@ -97,9 +167,23 @@ func (r *Reader) ReaderAtFor(name string) (io.ReaderAt, error) {
 }
 
 func (r *Reader) ReaderFor(name string) (io.Reader, error) {
-	fi, ok := r.name2Info[name]
-	if !ok || fi == nil {
-		return nil, fmt.Errorf("not found info with name %q", name)
+	fi, err := r.infoFor(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.ReaderForInfo(fi)
+}
+
+// ReaderForInfo is like ReaderFor, reading the content of fi, an info of
+// ListFiles, not that of the file named as fi, which is another one if the
+// name is stored again later, as tars could.
+func (r *Reader) ReaderForInfo(fi *Info) (io.Reader, error) {
+	if fi.Chunks != nil {
+		cr, err := newChunkReaderAt(r.r, fi)
+		if err != nil {
+			return nil, err
+		}
+		return &fileReader{r: cr, offset: 0, bound: int64(fi.Size)}, nil
 	}
 	fr := &fileReader{
 		r:      r.r,
@@ -109,8 +193,53 @@ func (r *Reader) ReaderFor(name string) (io.Reader, error) {
 	return fr, nil
 }
 
+// StoredRange returns the offset and the length of the stored content of the
+// file name in the star file, e.g. to prefetch it.
+func (r *Reader) StoredRange(name string) (int64, int64, error) {
+	fi, err := r.infoFor(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(fi.Offset), int64(fi.StoredSize()), nil
+}
+
+// VerifiedReaderFor is like ReaderFor, but fails at EOF with
+// ErrDigestMismatch if the content does not match the digest of the file.
+// ErrNoDigest is returned if the file has no digest.
+func (r *Reader) VerifiedReaderFor(name string) (io.Reader, error) {
+	fi, err := r.infoFor(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.VerifiedReaderForInfo(fi)
+}
+
+// VerifiedReaderForInfo is like VerifiedReaderFor, verifying the content of
+// fi, see ReaderForInfo.
+func (r *Reader) VerifiedReaderForInfo(fi *Info) (io.Reader, error) {
+	if len(fi.Digest) == 0 {
+		return nil, fmt.Errorf("%w of %q", ErrNoDigest, fi.Name)
+	}
+	algorithm, h, err := newDigestHash(fi.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("verifying %q, %w", fi.Name, err)
+	}
+	fr, err := r.ReaderForInfo(fi)
+	if err != nil {
+		return nil, err
+	}
+	vr := &verifyingReader{
+		r:         fr,
+		name:      fi.Name,
+		digest:    fi.Digest,
+		algorithm: algorithm,
+		h:         h,
+	}
+	return vr, nil
+}
+
 func (r *Reader) Mount(mountpoint string) error {
-	panic("todo")
+	return Mount(mountpoint, r)
 }
 
 type fileReaderAt struct {
@@ -120,10 +249,21 @@ type fileReaderAt struct {
 }
 
 func (r *fileReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
-	if off < 0 || off > (r.size-r.start+1) {
-		return 0, fmt.Errorf("ReaderAt want off within [0, %d], got %d", r.size-r.start+1, off)
+	if off < 0 || off > r.size {
+		return 0, fmt.Errorf("ReaderAt want off within [0, %d], got %d", r.size, off)
+	}
+	if off == r.size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > r.size {
+		p = p[:r.size-off]
+		err = io.EOF
+	}
+	n, rerr := r.r.ReadAt(p, off+r.start)
+	if rerr != nil && !(rerr == io.EOF && n == len(p)) {
+		return n, rerr
 	}
-	return r.r.ReadAt(p, off+r.start)
+	return n, err
 }
 
 type fileReader struct {
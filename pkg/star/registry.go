@@ -0,0 +1,261 @@
+package star
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// RegistryRef is a blob in an OCI distribution registry, written as
+// "[http(s)://]registry/repository@algorithm:hex". Registries are reached
+// by https, unless "http://" is given.
+type RegistryRef struct {
+	Scheme     string
+	Host       string
+	Repository string
+	Digest     string
+}
+
+// ParseRegistryRef parses a blob reference like
+// "ghcr.io/org/image@sha256:...".
+func ParseRegistryRef(ref string) (*RegistryRef, error) {
+	r := &RegistryRef{Scheme: "https"}
+	rest := ref
+	for _, scheme := range []string{"http", "https"} {
+		if strings.HasPrefix(rest, scheme+"://") {
+			r.Scheme, rest = scheme, rest[len(scheme)+3:]
+			break
+		}
+	}
+
+	at := strings.LastIndexByte(rest, '@')
+	slash := strings.IndexByte(rest, '/')
+	if at < 0 || slash < 0 || slash > at {
+		return nil, fmt.Errorf("parsing registry ref %q, want registry/repository@digest", ref)
+	}
+	r.Host, r.Repository, r.Digest = rest[:slash], rest[slash+1:at], rest[at+1:]
+
+	colon := strings.IndexByte(r.Digest, ':')
+	if len(r.Host) == 0 || len(r.Repository) == 0 || colon <= 0 || colon == len(r.Digest)-1 {
+		return nil, fmt.Errorf("parsing registry ref %q, want registry/repository@algorithm:hex", ref)
+	}
+
+	// Docker Hub is addressed as docker.io, but served elsewhere.
+	if r.Host == "docker.io" {
+		r.Host = "registry-1.docker.io"
+		if !strings.Contains(r.Repository, "/") {
+			r.Repository = "library/" + r.Repository
+		}
+	}
+	return r, nil
+}
+
+// URL returns the URL of the blob.
+func (r *RegistryRef) URL() string {
+	return fmt.Sprintf("%s://%s/v2/%s/blobs/%s", r.Scheme, r.Host, r.Repository, r.Digest)
+}
+
+func (r *RegistryRef) String() string {
+	return r.Host + "/" + r.Repository + "@" + r.Digest
+}
+
+// NewRegistryReaderAt returns an HTTPReaderAt over the blob ref pulled
+// anonymously, see ParseRegistryRef.
+func NewRegistryReaderAt(ref string) (*HTTPReaderAt, error) {
+	return NewRegistryReaderAtAuth(ref, "", "")
+}
+
+// NewRegistryReaderAtAuth is like NewRegistryReaderAt, authenticating with
+// username and password if they are not empty. Token auth challenges of the
+// registry are answered, and redirects to blob storage are followed without
+// leaking the credentials.
+func NewRegistryReaderAtAuth(ref, username, password string) (*HTTPReaderAt, error) {
+	rr, err := ParseRegistryRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: &registryTransport{
+			base:     DefaultHTTPTransport,
+			host:     rr.Host,
+			scope:    "repository:" + rr.Repository + ":pull",
+			username: username,
+			password: password,
+		},
+	}
+	hr, err := NewHTTPReaderAtClient(rr.URL(), client)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %s, %w", rr, err)
+	}
+	// Blobs never change, and blob storage redirected to has ETags of its
+	// own, so do not ask reads to match the ETag.
+	hr.etag = ""
+	return hr, nil
+}
+
+// registryTransport authorizes requests to a registry, and leaves requests
+// to other hosts, which blobs are redirected to, alone.
+type registryTransport struct {
+	base               http.RoundTripper
+	host               string
+	scope              string
+	username, password string
+
+	mu sync.Mutex
+	// Authorization header answering the last challenge.
+	authorization string
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	authorization := t.authorization
+	t.mu.Unlock()
+	resp, err := t.base.RoundTrip(withAuthorization(req, authorization))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Missing or expired authorization, answer the challenge and try again.
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	authorization, err = t.authorize(challenge)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.authorization = authorization
+	t.mu.Unlock()
+	return t.base.RoundTrip(withAuthorization(req, authorization))
+}
+
+// authorize returns the Authorization header answering challenge, fetching a
+// token for Bearer challenges.
+func (t *registryTransport) authorize(challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if len(t.username) == 0 {
+			return "", permanent(fmt.Errorf("registry %s asks for credentials", t.host))
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(t.username, t.password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		token, err := t.fetchToken(params)
+		var perr *permanentError
+		if errors.As(err, &perr) {
+			return "", permanent(fmt.Errorf("fetching token of registry %s, %w", t.host, perr.err))
+		}
+		if err != nil {
+			return "", fmt.Errorf("fetching token of registry %s, %w", t.host, err)
+		}
+		return "Bearer " + token, nil
+	}
+	return "", permanent(fmt.Errorf("registry %s asks for unsupported auth %q", t.host, challenge))
+}
+
+func (t *registryTransport) fetchToken(params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || len(params["realm"]) == 0 {
+		return "", permanent(fmt.Errorf("parsing realm %q, %v", params["realm"], err))
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if len(scope) == 0 {
+		scope = t.scope
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if len(t.username) > 0 {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Wrong credentials are not worth retrying, see statusError.
+		return "", statusError(resp)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding token, %w", err)
+	}
+	if len(body.Token) == 0 {
+		body.Token = body.AccessToken
+	}
+	if len(body.Token) == 0 {
+		return "", fmt.Errorf("no token in response")
+	}
+	return body.Token, nil
+}
+
+// withAuthorization returns a copy of req with the Authorization header, or
+// req itself if authorization is empty.
+func withAuthorization(req *http.Request, authorization string) *http.Request {
+	if len(authorization) == 0 {
+		return req
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", authorization)
+	return req
+}
+
+// parseChallenge parses a WWW-Authenticate header like
+// `Bearer realm="https://auth.example.com/token",service="example.com"`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	challenge = strings.TrimSpace(challenge)
+	sp := strings.IndexByte(challenge, ' ')
+	if sp < 0 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:sp], challenge[sp+1:]
+
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.IndexByte(rest, ','); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
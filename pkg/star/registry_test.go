@@ -0,0 +1,221 @@
+package star
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testRegistryRepo   = "org/image"
+	testRegistryDigest = "sha256:0123"
+	testRegistryBlob   = "0123456789"
+)
+
+// testRegistry serves one blob, asking for bearer tokens it issues, or for
+// basic auth if basic.
+type testRegistry struct {
+	t   *testing.T
+	url string
+	// Credentials the token endpoint asks for, anonymous if empty.
+	username, password string
+	basic              bool
+	// URL of the blob storage the blob redirects to, if not empty.
+	redirect string
+
+	mu sync.Mutex
+	// Tokens issued, only the last one is valid.
+	tokens int
+	scopes []string
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{t: t}
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	r.url = ts.URL
+	return r
+}
+
+func (r *testRegistry) ref() string {
+	return r.url + "/" + testRegistryRepo + "@" + testRegistryDigest
+}
+
+// expire makes the tokens issued so far invalid.
+func (r *testRegistry) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens++
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	valid := fmt.Sprintf("Bearer token-%d", r.tokens)
+	r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		user, pass, ok := req.BasicAuth()
+		if len(r.username) > 0 && (!ok || user != r.username || pass != r.password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if len(r.username) == 0 && ok {
+			r.t.Errorf("anonymous token request with credentials of %q", user)
+		}
+		r.mu.Lock()
+		r.scopes = append(r.scopes, req.URL.Query().Get("service")+" "+req.URL.Query().Get("scope"))
+		r.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"token": strings.TrimPrefix(valid, "Bearer ")})
+		return
+	}
+
+	if req.URL.Path != "/v2/"+testRegistryRepo+"/blobs/"+testRegistryDigest {
+		http.NotFound(w, req)
+		return
+	}
+	authorized := req.Header.Get("Authorization") == valid
+	if r.basic {
+		user, pass, ok := req.BasicAuth()
+		authorized = ok && user == r.username && pass == r.password
+	}
+	if !authorized {
+		if r.basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, r.url, testRegistryRepo))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if len(r.redirect) > 0 {
+		http.Redirect(w, req, r.redirect, http.StatusTemporaryRedirect)
+		return
+	}
+	w.Header().Set("ETag", `"`+testRegistryDigest+`"`)
+	http.ServeContent(w, req, "", time.Time{}, strings.NewReader(testRegistryBlob))
+}
+
+func readTestBlob(t *testing.T, ref, username, password string) {
+	t.Helper()
+	hr, err := NewRegistryReaderAtAuth(ref, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr.SetRetries(0, time.Millisecond)
+	p := make([]byte, hr.Size())
+	if n, err := hr.ReadAt(p, 0); err != nil || string(p[:n]) != testRegistryBlob {
+		t.Fatalf("want %q, got %q %v", testRegistryBlob, p[:n], err)
+	}
+}
+
+func TestRegistryAnonymousToken(t *testing.T) {
+	r := newTestRegistry(t)
+	readTestBlob(t, r.ref(), "", "")
+	if want := "test repository:" + testRegistryRepo + ":pull"; len(r.scopes) != 1 || r.scopes[0] != want {
+		t.Errorf("want one token of %q, got %q", want, r.scopes)
+	}
+}
+
+func TestRegistryBearerChallenge(t *testing.T) {
+	r := newTestRegistry(t)
+	r.username, r.password = "user", "secret"
+	readTestBlob(t, r.ref(), "user", "secret")
+
+	if _, err := NewRegistryReaderAtAuth(r.ref(), "user", "wrong"); err == nil {
+		t.Errorf("wrong password, want error")
+	}
+}
+
+func TestRegistryBasicChallenge(t *testing.T) {
+	r := newTestRegistry(t)
+	r.username, r.password, r.basic = "user", "secret", true
+	readTestBlob(t, r.ref(), "user", "secret")
+
+	if _, err := NewRegistryReaderAt(r.ref()); err == nil {
+		t.Errorf("anonymous pull of a basic auth registry, want error")
+	}
+}
+
+func TestRegistryExpiredToken(t *testing.T) {
+	r := newTestRegistry(t)
+	hr, err := NewRegistryReaderAt(r.ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr.SetRetries(0, time.Millisecond)
+
+	// The 401 of the expired token is answered with a new token.
+	r.expire()
+	p := make([]byte, 4)
+	if n, err := hr.ReadAt(p, 2); err != nil || string(p[:n]) != "2345" {
+		t.Errorf("want \"2345\", got %q %v", p[:n], err)
+	}
+	if len(r.scopes) != 2 {
+		t.Errorf("want 2 tokens fetched, got %d", len(r.scopes))
+	}
+}
+
+func TestRegistryRedirect(t *testing.T) {
+	var (
+		mu             sync.Mutex
+		authorizations []string
+	)
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		authorizations = append(authorizations, req.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"storage"`)
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader([]byte(testRegistryBlob)))
+	}))
+	defer storage.Close()
+
+	r := newTestRegistry(t)
+	r.username, r.password = "user", "secret"
+	// Another host name of the storage, so it is another host than the
+	// registry, not only another port.
+	r.redirect = strings.Replace(storage.URL, "127.0.0.1", "localhost", 1) + "/blob?signature=x"
+	readTestBlob(t, r.ref(), "user", "secret")
+
+	if len(authorizations) == 0 {
+		t.Fatalf("want the blob storage reached")
+	}
+	for _, authorization := range authorizations {
+		if len(authorization) > 0 {
+			t.Errorf("want no Authorization forwarded to blob storage, got %q", authorization)
+		}
+	}
+}
+
+func TestParseRegistryRef(t *testing.T) {
+	for ref, want := range map[string]string{
+		"ghcr.io/org/image@sha256:ab":           "https://ghcr.io/v2/org/image/blobs/sha256:ab",
+		"http://localhost:5000/a/b/c@sha256:ab": "http://localhost:5000/v2/a/b/c/blobs/sha256:ab",
+		"docker.io/alpine@sha256:ab":            "https://registry-1.docker.io/v2/library/alpine/blobs/sha256:ab",
+	} {
+		rr, err := ParseRegistryRef(ref)
+		if err != nil {
+			t.Errorf("parsing %q, %v", ref, err)
+		} else if rr.URL() != want {
+			t.Errorf("parsing %q, want %q, got %q", ref, want, rr.URL())
+		}
+	}
+	for _, ref := range []string{"image@sha256:ab", "ghcr.io/org/image", "ghcr.io/@sha256:ab", "ghcr.io/org/image@sha256:", "ghcr.io/org/image@ab"} {
+		if _, err := ParseRegistryRef(ref); err == nil {
+			t.Errorf("parsing %q, want error", ref)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="example.com",scope="repository:a,b:pull"`)
+	if scheme != "Bearer" || params["realm"] != "https://auth.example.com/token" ||
+		params["service"] != "example.com" || params["scope"] != "repository:a,b:pull" {
+		t.Errorf("got %q %q", scheme, params)
+	}
+}
@@ -0,0 +1,133 @@
+package star
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// Upgrade rewrites the star file of sr to w in the LatestVersion. Files keep
+// their compression, chunk size and digest algorithm, files without a digest
+// get one of DefaultDigestAlgorithm. Files sharing content keep sharing it.
+func Upgrade(w io.Writer, sr *Reader) error {
+	return Repack(w, sr, nil)
+}
+
+// Repack is like Upgrade, the payloads of the hot files are placed first, in
+// the order given, and marked so, see Writer.MarkHotEnd. Hot files missing in
+// sr are skipped, hard links place their targets first. The other payloads
+// keep their order, and the infos keep theirs, as the last of the files
+// stored with the same name is the one read.
+func Repack(w io.Writer, sr *Reader, hot []string) error {
+	var (
+		sw = NewWriter(w)
+		// Infos written of those of sr.
+		copies = map[*Info]*Info{}
+		// Infos of sr holding the content of the last file of each name.
+		contents = map[string]*Info{}
+	)
+	copyFile := func(info, target *Info) error {
+		if err := sw.copyFile(sr, info, copies[target]); err != nil {
+			return err
+		}
+		copies[info] = sw.infos[len(sw.infos)-1]
+		return nil
+	}
+
+	for _, name := range hot {
+		nd, ok := sr.nodes[CleanName(name)]
+		if !ok {
+			continue
+		}
+		if nd = sr.hardlinkTarget(nd); nd == nil || copies[nd.info] != nil || !nd.info.Mode.IsRegular() {
+			continue
+		}
+		if err := copyFile(nd.info, nil); err != nil {
+			return err
+		}
+	}
+	if len(copies) > 0 {
+		if err := sw.MarkHotEnd(); err != nil {
+			return err
+		}
+	}
+
+	for _, info := range sr.ListFiles() {
+		// Hard links share the content of the last file named as their
+		// Linkname before them, which is not the last one written.
+		var target *Info
+		if info.Kind == fs.KindHardlink {
+			target = contents[CleanName(info.Linkname)]
+			contents[CleanName(info.Name)] = target
+		} else {
+			contents[CleanName(info.Name)] = info
+		}
+		if copies[info] != nil {
+			continue
+		}
+		if err := copyFile(info, target); err != nil {
+			return err
+		}
+	}
+
+	infos := make([]*Info, 0, len(sw.infos))
+	for _, info := range sr.ListFiles() {
+		infos = append(infos, copies[info])
+	}
+	sw.infos = infos
+	return sw.Close()
+}
+
+// copyFile writes the file of sr, keeping its compression. A hard link shares
+// the content of target, if not nil, see writeInfo.
+func (w *Writer) copyFile(sr *Reader, info, target *Info) error {
+	if info.Kind == fs.KindHardlink || !info.Mode.IsRegular() || info.Size == 0 {
+		return w.writeInfo(info.FileInfo, target)
+	}
+
+	var err error
+	if info.Chunks != nil {
+		err = w.SetCompression(info.Chunks.Compression, int(info.Chunks.ChunkSize))
+	} else {
+		err = w.SetCompression("", 0)
+	}
+	if err != nil {
+		return fmt.Errorf("copying %q, %w", info.Name, err)
+	}
+
+	algorithm := DefaultDigestAlgorithm
+	if i := strings.IndexByte(info.Digest, ':'); i > 0 {
+		algorithm = info.Digest[:i]
+	}
+	if err := w.SetDigestAlgorithm(algorithm); err != nil {
+		return fmt.Errorf("copying %q, %w", info.Name, err)
+	}
+
+	ra, err := sr.readerAtFor(info)
+	if err != nil {
+		return err
+	}
+	data := io.NewSectionReader(ra, 0, int64(info.Size))
+
+	// The stored digest is trusted for dedup, the content is hashed again
+	// while being written.
+	if len(info.Digest) > 0 {
+		dup, err := w.WriteHeaderDigest(info.FileInfo, info.Digest)
+		if err != nil || dup {
+			return err
+		}
+		return w.copyFrom(info.Name, data)
+	}
+	return w.writeFile(&fs.File{FileInfo: *info.FileInfo, Data: sectionReadCloser{data}})
+}
+
+// sectionReadCloser lets writeFile seek back the content after hashing it.
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (sectionReadCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,143 @@
+package star
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+func TestWriterMarkHotEnd(t *testing.T) {
+	files := []testFile{
+		{FileInfo: fs.FileInfo{Name: "hot", Mode: 0644}, data: "hot content"},
+		{FileInfo: fs.FileInfo{Name: "cold", Mode: 0644}, data: "cold content"},
+	}
+	sr, err := NewReader(bytes.NewReader(writeTestStar(t, files, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.HotEnd() != 0 {
+		t.Errorf("not marked, want hot end 0, got %d", sr.HotEnd())
+	}
+
+	var buf bytes.Buffer
+	sw := NewWriter(&buf)
+	if err := sw.WriteFiles(&sliceReader{files: files[:1]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.MarkHotEnd(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.WriteFiles(&sliceReader{files: files[1:]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sr, err = NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hot, cold := sr.ListFiles()[0], sr.ListFiles()[1]
+	if want := int64(hot.Offset + hot.Size); sr.HotEnd() != want || int64(cold.Offset) != want {
+		t.Errorf("want hot end %d, where cold starts at %d, got %d", want, cold.Offset, sr.HotEnd())
+	}
+
+	sw = NewWriter(ioutil.Discard)
+	if err := sw.WriteHeader(&fs.FileInfo{Name: "f", Mode: 0644, Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.MarkHotEnd(); err == nil {
+		t.Error("marking with content missing, want error")
+	}
+}
+
+func TestRepack(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	file := func(name string, kind fs.Kind, linkname, data string) testFile {
+		fi := fs.FileInfo{Name: name, Mode: 0644, Kind: kind, Linkname: linkname, Mtime: mtime, Atime: mtime, Ctime: mtime}
+		return testFile{FileInfo: fi, data: data}
+	}
+	files := append(testFiles(),
+		file("a", fs.KindNormal, "", "old a"),
+		file("h", fs.KindHardlink, "a", ""),
+		// Replaces a, h still links to the old one.
+		file("a", fs.KindNormal, "", "new a"),
+		file("cold", fs.KindNormal, "", "cold"),
+	)
+	for _, tc := range []struct {
+		name  string
+		setup func(*Writer)
+	}{
+		{"plain", nil},
+		{"zstd", func(w *Writer) { w.SetCompression("zstd", testChunkSize) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, err := NewReader(bytes.NewReader(writeTestStar(t, files, tc.setup)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hot := []string{"a", "missing", "h", "etc/hard", "etc/big", "etc"}
+			var buf bytes.Buffer
+			if err := Repack(&buf, src, hot); err != nil {
+				t.Fatal(err)
+			}
+			sr := checkTestStar(t, buf.Bytes(), files)
+
+			// The infos keep their order and content, only payloads move.
+			if got, want := sr.ListNames(), src.ListNames(); !reflect.DeepEqual(got, want) {
+				t.Errorf("names, want %q, got %q", want, got)
+			}
+			for _, info := range sr.ListFiles() {
+				if info.Mode.IsRegular() && info.Size > 0 && (info.Chunks != nil) != (tc.setup != nil) {
+					t.Errorf("compression of %q, want kept", info.Name)
+				}
+			}
+			for name, want := range map[string]string{"a": "new a", "h": "old a"} {
+				if data, err := sr.ReadFile(name); err != nil || string(data) != want {
+					t.Errorf("content of %q, want %q, got %q %v", name, want, data, err)
+				}
+			}
+
+			// The hot payloads go first: the new a, the old a h links to,
+			// etc/hosts etc/hard links to, etc/big and etc/big.copy sharing
+			// its content.
+			hotEnd := uint64(sr.HotEnd())
+			if hotEnd == 0 {
+				t.Fatal("want hot end marked")
+			}
+			hotData := map[string]bool{"new a": true, "old a": true, "127.0.0.1 localhost\n": true}
+			for i, info := range sr.ListFiles() {
+				if !info.Mode.IsRegular() || info.Kind != fs.KindNormal || info.Size == 0 {
+					continue
+				}
+				isHot := hotData[files[i].data] || strings.HasPrefix(info.Name, "etc/big")
+				if inHot := info.Offset < hotEnd; isHot != inHot {
+					t.Errorf("%q, info %d at %d, want hot %v, hot end %d", info.Name, i, info.Offset, isHot, hotEnd)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeKeepsOrder(t *testing.T) {
+	src, err := NewReader(bytes.NewReader(writeTestStar(t, testFiles(), nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Upgrade(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	sr := checkTestStar(t, buf.Bytes(), testFiles())
+	if sr.HotEnd() != 0 {
+		t.Errorf("want no hot end, got %d", sr.HotEnd())
+	}
+	if got, want := strings.Join(sr.ListNames(), " "), strings.Join(src.ListNames(), " "); got != want {
+		t.Errorf("names, want %s, got %s", want, got)
+	}
+}
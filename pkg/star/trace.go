@@ -0,0 +1,173 @@
+package star
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TraceVersion is the version of the trace format written by Trace.
+const TraceVersion = 1
+
+// Trace records the files read through ReaderAtFor of a Reader, in the order
+// they are first touched, with the byte ranges of their content read. A trace
+// of a workload starting up is a profile of the files it needs first.
+type Trace struct {
+	mu     sync.Mutex
+	start  time.Time
+	files  []*TraceFile
+	byName map[string]*TraceFile
+}
+
+// TraceFile is a file touched, as written in the trace.
+type TraceFile struct {
+	Name string `json:"name"`
+	// Milliseconds from the start of the trace to the first touch.
+	FirstAccessMs int64 `json:"first_access_ms"`
+	// Ranges of the content read, sorted and merged.
+	Ranges []TraceRange `json:"ranges"`
+}
+
+// TraceRange is a byte range of the content of a file.
+type TraceRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// traceJSON is the trace as written.
+type traceJSON struct {
+	Version int          `json:"version"`
+	Files   []*TraceFile `json:"files"`
+}
+
+// NewTrace returns an empty trace started now.
+func NewTrace() *Trace {
+	return &Trace{
+		start:  time.Now(),
+		byName: map[string]*TraceFile{},
+	}
+}
+
+// SetTrace records the files read through ReaderAtFor to t, nil to stop.
+func (r *Reader) SetTrace(t *Trace) {
+	r.trace = t
+}
+
+// touch records name is touched, and returns its record.
+func (t *Trace) touch(name string) *TraceFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tf, ok := t.byName[name]
+	if !ok {
+		tf = &TraceFile{
+			Name:          name,
+			FirstAccessMs: time.Since(t.start).Milliseconds(),
+			Ranges:        []TraceRange{},
+		}
+		t.byName[name] = tf
+		t.files = append(t.files, tf)
+	}
+	return tf
+}
+
+// read records length bytes at off of tf are read. Sequential reads extend
+// the last range, others are merged only when the ranges are asked for.
+func (t *Trace) read(tf *TraceFile, off, length int64) {
+	if length <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := len(tf.Ranges); n > 0 && tf.Ranges[n-1].Offset+tf.Ranges[n-1].Length == off {
+		tf.Ranges[n-1].Length += length
+		return
+	}
+	tf.Ranges = append(tf.Ranges, TraceRange{Offset: off, Length: length})
+}
+
+// Files returns the files touched so far, in the order first touched.
+func (t *Trace) Files() []TraceFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	files := make([]TraceFile, 0, len(t.files))
+	for _, tf := range t.files {
+		tf.Ranges = mergeRanges(tf.Ranges)
+		f := *tf
+		f.Ranges = append([]TraceRange{}, tf.Ranges...)
+		files = append(files, f)
+	}
+	return files
+}
+
+// WriteTo writes the trace as JSON.
+func (t *Trace) WriteTo(w io.Writer) (int64, error) {
+	files := t.Files()
+	tj := &traceJSON{Version: TraceVersion, Files: make([]*TraceFile, 0, len(files))}
+	for i := range files {
+		tj.Files = append(tj.Files, &files[i])
+	}
+	data, err := json.MarshalIndent(tj, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// ReadTrace reads a trace written by Trace.WriteTo.
+func ReadTrace(r io.Reader) ([]TraceFile, error) {
+	var tj traceJSON
+	if err := json.NewDecoder(r).Decode(&tj); err != nil {
+		return nil, fmt.Errorf("decoding trace, %w", err)
+	}
+	if tj.Version != TraceVersion {
+		return nil, fmt.Errorf("unsupported trace version %d, want %d", tj.Version, TraceVersion)
+	}
+	files := make([]TraceFile, 0, len(tj.Files))
+	for i, tf := range tj.Files {
+		if tf == nil || tf.Name == "" {
+			return nil, fmt.Errorf("decoding trace, file %d has no name", i)
+		}
+		for _, r := range tf.Ranges {
+			if r.Offset < 0 || r.Length <= 0 {
+				return nil, fmt.Errorf("decoding trace, invalid range %d+%d of %q", r.Offset, r.Length, tf.Name)
+			}
+		}
+		files = append(files, *tf)
+	}
+	return files, nil
+}
+
+// mergeRanges sorts ranges and merges the overlapping or adjacent ones.
+func mergeRanges(ranges []TraceRange) []TraceRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Offset < ranges[j].Offset
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.Offset <= merged[n-1].Offset+merged[n-1].Length {
+			if end := r.Offset + r.Length; end > merged[n-1].Offset+merged[n-1].Length {
+				merged[n-1].Length = end - merged[n-1].Offset
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// tracingReaderAt records the reads of a file to a trace.
+type tracingReaderAt struct {
+	r     io.ReaderAt
+	trace *Trace
+	tf    *TraceFile
+}
+
+func (r *tracingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	r.trace.read(r.tf, off, int64(n))
+	return n, err
+}
@@ -0,0 +1,64 @@
+package star
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTraceRoundTrip(t *testing.T) {
+	tr := NewTrace()
+	a, b := tr.touch("etc/hosts"), tr.touch("bin/sh")
+	tr.read(a, 100, 50)
+	tr.read(a, 0, 100)
+	tr.read(a, 400, 10)
+	// Sequential reads extend the last range.
+	tr.read(a, 410, 20)
+	tr.read(a, 430, 5)
+	tr.read(b, 0, 0)
+	if len(a.Ranges) != 3 {
+		t.Errorf("sequential reads, want 3 ranges recorded, got %v", a.Ranges)
+	}
+	if tr.touch("etc/hosts") != a {
+		t.Fatal("touching twice, want the same record")
+	}
+
+	var buf bytes.Buffer
+	if _, err := tr.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ReadTrace(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "etc/hosts" || files[1].Name != "bin/sh" {
+		t.Fatalf("want etc/hosts and bin/sh, got %+v", files)
+	}
+	want := []TraceRange{{0, 150}, {400, 35}}
+	if !reflect.DeepEqual(files[0].Ranges, want) {
+		t.Errorf("ranges, want %v, got %v", want, files[0].Ranges)
+	}
+	if len(files[1].Ranges) != 0 {
+		t.Errorf("ranges of bin/sh, want none, got %v", files[1].Ranges)
+	}
+}
+
+func TestReadTraceCorrupted(t *testing.T) {
+	for name, trace := range map[string]string{
+		"empty":           ``,
+		"truncated":       `{"version": 1, "files": [{"name": "a"`,
+		"not json":        `version 1`,
+		"no version":      `{"files": []}`,
+		"future version":  `{"version": 2, "files": []}`,
+		"wrong type":      `{"version": 1, "files": {}}`,
+		"null file":       `{"version": 1, "files": [null]}`,
+		"no name":         `{"version": 1, "files": [{"ranges": []}]}`,
+		"negative offset": `{"version": 1, "files": [{"name": "a", "ranges": [{"offset": -1, "length": 1}]}]}`,
+		"empty range":     `{"version": 1, "files": [{"name": "a", "ranges": [{"offset": 0, "length": 0}]}]}`,
+	} {
+		if _, err := ReadTrace(strings.NewReader(trace)); err == nil {
+			t.Errorf("%s, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package star
+
+import (
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// maxSymlinks is the most symlinks followed by one lookup, like linux.
+const maxSymlinks = 40
+
+// node is an entry of the directory tree of a star file. Directories never
+// listed in the star file are implied by the entries living in them.
+type node struct {
+	// Cleaned name, see CleanName.
+	name string
+	info *Info
+	// Index of info in the star file. Implied directories are numbered after
+	// all infos, in the order they are implied, the root is -1.
+	index int
+	// Reader holding info, nil if info is implied.
+	layer  *Reader
+	parent *node
+	// Children by base name, nil if not a directory.
+	children map[string]*node
+	// Node holding the content of a hard link, nil if missing or not a hard
+	// link. Resolved as the star file is read, so a hard link keeps its
+	// target in the same layer, even if an upper layer replaces the name.
+	target *node
+}
+
+// dirTree is the directory tree of a Reader or a LayeredReader, it serves
+// the lookups both have in common.
+type dirTree struct {
+	root *node
+	// Nodes by cleaned name.
+	nodes map[string]*node
+	// Number of indexes given to nodes.
+	indexes int
+}
+
+func newDirTree() dirTree {
+	root := &node{name: ".", info: impliedDirInfo("."), index: -1, children: map[string]*node{}}
+	return dirTree{root: root, nodes: map[string]*node{".": root}}
+}
+
+// buildTree assembles the directory tree of the infos. Like extracting a tar,
+// later entries replace earlier ones of the same name.
+func (r *Reader) buildTree() {
+	implied := len(r.infos)
+	r.dirTree = newDirTree()
+
+	var dirFor func(name string) *node
+	dirFor = func(name string) *node {
+		if dn, ok := r.nodes[name]; ok && dn.children != nil {
+			return dn
+		}
+		parent := dirFor(path.Dir(name))
+		dn := &node{
+			name:     name,
+			info:     impliedDirInfo(name),
+			index:    implied,
+			parent:   parent,
+			children: map[string]*node{},
+		}
+		implied++
+		r.replace(parent, path.Base(name), dn)
+		return dn
+	}
+
+	for i, info := range r.infos {
+		name := CleanName(info.Name)
+		if name == "." {
+			r.root.info, r.root.layer = info, r
+			continue
+		}
+
+		// Whiteouts only delete files of lower layers, but
+		// the directories they live in exist.
+		switch info.Kind {
+		case fs.KindWhiteout:
+			dirFor(path.Dir(name))
+			continue
+		case fs.KindOpaque:
+			dirFor(name)
+			continue
+		}
+
+		parent := dirFor(path.Dir(name))
+		if nd, ok := parent.children[path.Base(name)]; ok && nd.children != nil && info.Mode.IsDir() {
+			nd.info, nd.index, nd.layer = info, i, r
+			continue
+		}
+		nd := &node{name: name, info: info, index: i, layer: r, parent: parent}
+		if info.Mode.IsDir() {
+			nd.children = map[string]*node{}
+		}
+		if info.Kind == fs.KindHardlink {
+			nd.target = r.linkTarget(info.Linkname)
+		}
+		r.replace(parent, path.Base(name), nd)
+	}
+	r.indexes = implied
+}
+
+// view returns the tree itself, see View.
+func (t *dirTree) view() *dirTree {
+	return t
+}
+
+// replace puts nd as the child base of parent, dropping the earlier child
+// and all its descendants.
+func (t *dirTree) replace(parent *node, base string, nd *node) {
+	t.remove(parent, base)
+	parent.children[base] = nd
+	t.nodes[nd.name] = nd
+}
+
+// remove drops the child base of parent and all its descendants.
+func (t *dirTree) remove(parent *node, base string) {
+	old, ok := parent.children[base]
+	if !ok {
+		return
+	}
+	delete(parent.children, base)
+	t.drop(old)
+}
+
+// drop forgets nd and all its descendants by name.
+func (t *dirTree) drop(nd *node) {
+	delete(t.nodes, nd.name)
+	for _, child := range nd.children {
+		t.drop(child)
+	}
+}
+
+// lookup returns the node of name, following symlinks in the directories of
+// name, and the symlink name itself if follow. Symlinks are resolved within
+// the star file, absolute ones from its root.
+func (t *dirTree) lookup(op, name string, follow bool) (*node, error) {
+	cleaned := CleanName(name)
+	if nd, ok := t.nodes[cleaned]; ok && (!follow || nd.info.Mode&os.ModeSymlink == 0) {
+		return nd, nil
+	}
+
+	var (
+		cur   = t.root
+		comps = strings.Split(cleaned, "/")
+		hops  = 0
+	)
+	for len(comps) > 0 {
+		comp := comps[0]
+		comps = comps[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			if cur.parent != nil {
+				cur = cur.parent
+			}
+			continue
+		}
+
+		if cur.children == nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		nd, ok := cur.children[comp]
+		if !ok {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		if nd.info.Mode&os.ModeSymlink != 0 && (len(comps) > 0 || follow) {
+			if hops++; hops > maxSymlinks {
+				return nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target := nd.info.Linkname
+			if path.IsAbs(target) {
+				cur = t.root
+			}
+			comps = append(strings.Split(target, "/"), comps...)
+			continue
+		}
+		cur = nd
+	}
+	return cur, nil
+}
+
+// linkTarget returns the node a hard link to linkname, read now, points to,
+// nil if there is no file of that name yet.
+func (t *dirTree) linkTarget(linkname string) *node {
+	target, ok := t.nodes[CleanName(linkname)]
+	if !ok || target.children != nil {
+		return nil
+	}
+	if target.info.Kind == fs.KindHardlink {
+		return target.target
+	}
+	return target
+}
+
+// hardlinkTarget returns the node holding the content of nd, which is nd
+// itself if it is not a hard link, or nil if the target is missing.
+func (t *dirTree) hardlinkTarget(nd *node) *node {
+	if nd.info.Kind != fs.KindHardlink {
+		return nd
+	}
+	return nd.target
+}
+
+// Stat returns the info of the file name, following symlinks. Names are
+// cleaned, so "./a/b/", "/a/b" and "a/b" are the same file. Sys of the
+// returned os.FileInfo is the *Info.
+func (t *dirTree) Stat(name string) (os.FileInfo, error) {
+	nd, err := t.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(path.Base(CleanName(name)), nd.info), nil
+}
+
+// Lstat is like Stat, but does not follow name if it is a symlink.
+func (t *dirTree) Lstat(name string) (os.FileInfo, error) {
+	nd, err := t.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(path.Base(CleanName(name)), nd.info), nil
+}
+
+// ReadLink returns the target of the symlink name.
+func (t *dirTree) ReadLink(name string) (string, error) {
+	nd, err := t.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if nd.info.Mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+	}
+	return nd.info.Linkname, nil
+}
+
+// ReadDir returns the entries of the directory dir sorted by name, like
+// os.ReadDir.
+func (t *dirTree) ReadDir(dir string) ([]os.DirEntry, error) {
+	dn, err := t.lookup("readdir", dir, true)
+	if err != nil {
+		return nil, err
+	}
+	if dn.children == nil {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	entries := make([]os.DirEntry, 0, len(dn.children))
+	for base, nd := range dn.children {
+		entries = append(entries, iofs.FileInfoToDirEntry(newFileInfo(base, nd.info)))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// Stat returns the info as an fs.FileInfo, named by its base name.
+func (i *Info) Stat() iofs.FileInfo {
+	return newFileInfo(path.Base(CleanName(i.Name)), i)
+}
+
+// fileInfo exposes an Info as an os.FileInfo.
+type fileInfo struct {
+	name string
+	info *Info
+}
+
+func newFileInfo(name string, info *Info) *fileInfo {
+	if name == "." || name == "/" {
+		name = "."
+	}
+	return &fileInfo{name: name, info: info}
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	if fi.info.Mode&os.ModeSymlink != 0 {
+		return int64(len(fi.info.Linkname))
+	}
+	return int64(fi.info.Size)
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	return fi.info.Mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.info.Mtime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.info.Mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return fi.info
+}
+
+// impliedDirInfo returns the info for a directory which is not listed in the
+// star file, but some entries of the star file live in it.
+func impliedDirInfo(name string) *Info {
+	return &Info{
+		FileInfo: &fs.FileInfo{
+			Name: name,
+			Mode: os.ModeDir | 0755,
+		},
+	}
+}
+
+// CleanName strips the leading "./", "/" and the trailing "/" of name, so
+// entries of star files created from tars could be addressed the same way,
+// by lookups and by the patterns selecting entries alike.
+func CleanName(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,76 @@
+package star
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+func TestReaderFS(t *testing.T) {
+	for _, setup := range []func(*Writer){nil, func(w *Writer) { w.SetCompression("zstd", testChunkSize) }} {
+		sr, err := NewReader(bytes.NewReader(writeTestStar(t, testFiles(), setup)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fstest.TestFS(sr, "etc/hosts", "etc/big", "etc/hard", "etc/link", "dev/null", "bin/su"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	files := testFiles()
+	symlink := func(name, target string) testFile {
+		return testFile{FileInfo: fs.FileInfo{Name: name, Mode: os.ModeSymlink | 0777, Linkname: target}}
+	}
+	files = append(files,
+		symlink("abs", "/etc"),
+		symlink("up", "../../etc"),
+		symlink("loop1", "loop2"),
+		symlink("loop2", "loop1"),
+		// Names of tars, cleaned, replace earlier entries of the same name.
+		testFile{FileInfo: fs.FileInfo{Name: "./etc/hosts", Mode: 0600}, data: "replaced"},
+	)
+	sr, err := NewReader(bytes.NewReader(writeTestStar(t, files, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"/etc/hosts", "etc/hosts", nil},
+		{"etc/../etc/hosts/", "etc/hosts", nil},
+		{"../../etc/hosts", "etc/hosts", nil},
+		{"abs/hosts", "etc/hosts", nil},
+		{"up/hosts", "etc/hosts", nil},
+		{"etc/link", "etc/hosts", nil},
+		{"loop1", "", syscall.ELOOP},
+		{"loop1/x", "", syscall.ELOOP},
+		{"etc/hosts/x", "", syscall.ENOTDIR},
+		{"etc/missing", "", os.ErrNotExist},
+	} {
+		nd, err := sr.lookup("stat", tc.name, true)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("lookup %q, want error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if err == nil && nd.name != tc.want {
+			t.Errorf("lookup %q, want %q, got %q", tc.name, tc.want, nd.name)
+		}
+	}
+
+	if data, err := sr.ReadFile("abs/hosts"); err != nil || string(data) != "replaced" {
+		t.Errorf("want replaced etc/hosts, got %q %v", data, err)
+	}
+	if fi, err := sr.Lstat("etc/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat of symlink, got %v %v", fi, err)
+	}
+}
@@ -0,0 +1,807 @@
+// +build linux
+
+package star
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// upperInoBase offsets the inode numbers of files in the upper directory, so
+// they never clash with those of files in star files.
+const upperInoBase = 1 << 62
+
+// upperNode serves one file of a writable mount, see MountOptions.Upper, which is in the upper
+// directory, in the star files, or both if the upper one shadows it.
+type upperNode struct {
+	fusefs.Inode
+	// Entry of the star files at the path of the node, nil if there is none
+	// or it is deleted.
+	lower *node
+	// Serializes copying the node up, so concurrent writers do not copy it
+	// twice.
+	copyUpMu sync.Mutex
+}
+
+// upperRoot is the root directory of a writable mount.
+type upperRoot struct {
+	upperNode
+	tree  *dirTree
+	upper string
+	opts  *MountOptions
+}
+
+func newUpperRoot(tree *dirTree, opts *MountOptions) (fusefs.InodeEmbedder, error) {
+	r := &upperRoot{tree: tree, upper: opts.Upper, opts: opts}
+	r.lower = tree.root
+	return r, nil
+}
+
+var (
+	_ = (fusefs.NodeLookuper)((*upperNode)(nil))
+	_ = (fusefs.NodeReaddirer)((*upperNode)(nil))
+	_ = (fusefs.NodeGetattrer)((*upperNode)(nil))
+	_ = (fusefs.NodeSetattrer)((*upperNode)(nil))
+	_ = (fusefs.NodeOpener)((*upperNode)(nil))
+	_ = (fusefs.NodeCreater)((*upperNode)(nil))
+	_ = (fusefs.NodeMkdirer)((*upperNode)(nil))
+	_ = (fusefs.NodeMknoder)((*upperNode)(nil))
+	_ = (fusefs.NodeSymlinker)((*upperNode)(nil))
+	_ = (fusefs.NodeLinker)((*upperNode)(nil))
+	_ = (fusefs.NodeUnlinker)((*upperNode)(nil))
+	_ = (fusefs.NodeRmdirer)((*upperNode)(nil))
+	_ = (fusefs.NodeRenamer)((*upperNode)(nil))
+	_ = (fusefs.NodeReadlinker)((*upperNode)(nil))
+	_ = (fusefs.NodeGetxattrer)((*upperNode)(nil))
+	_ = (fusefs.NodeSetxattrer)((*upperNode)(nil))
+	_ = (fusefs.NodeRemovexattrer)((*upperNode)(nil))
+	_ = (fusefs.NodeListxattrer)((*upperNode)(nil))
+	_ = (fusefs.NodeStatfser)((*upperNode)(nil))
+)
+
+func toUpperNode(op fusefs.InodeEmbedder) *upperNode {
+	if r, ok := op.(*upperRoot); ok {
+		return &r.upperNode
+	}
+	return op.(*upperNode)
+}
+
+func (n *upperNode) root() *upperRoot {
+	return n.Root().Operations().(*upperRoot)
+}
+
+// path returns the path of the node in the upper directory.
+func (n *upperNode) path() string {
+	return filepath.Join(n.root().upper, n.Path(nil))
+}
+
+// upperStat returns the stat of the node in the upper directory, or false if
+// it is not there.
+func (n *upperNode) upperStat() (*syscall.Stat_t, bool) {
+	return lstat(n.path())
+}
+
+func lstat(name string) (*syscall.Stat_t, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(name, &st); err != nil {
+		return nil, false
+	}
+	return &st, true
+}
+
+// lowerInfo returns the info of the content of the lower entry, following
+// hard links, or nil if there is none.
+func (n *upperNode) lowerInfo() *Info {
+	return n.root().contentOf(n.lower)
+}
+
+// contentOf returns the info of nd, or of the target of nd if it is a hard
+// link, nil if nd is nil or its target is missing.
+func (r *upperRoot) contentOf(nd *node) *Info {
+	if nd == nil {
+		return nil
+	}
+	if nd = r.tree.hardlinkTarget(nd); nd == nil {
+		return nil
+	}
+	return nd.info
+}
+
+// lowerChild returns the lower entry name in the directory upperDir, whose
+// lower entry is lower, unless it is deleted, or the directory is opaque.
+func (r *upperRoot) lowerChild(upperDir string, lower *node, name string) *node {
+	if lower == nil || lower.children == nil {
+		return nil
+	}
+	child, ok := lower.children[name]
+	if !ok {
+		return nil
+	}
+	if _, ok := lstat(filepath.Join(upperDir, fs.WhiteoutOpaque)); ok {
+		return nil
+	}
+	if _, ok := lstat(filepath.Join(upperDir, fs.WhiteoutPrefix+name)); ok {
+		return nil
+	}
+	return child
+}
+
+func (n *upperNode) lowerChild(name string) *node {
+	return n.root().lowerChild(n.path(), n.lower, name)
+}
+
+// entries returns the merged entries of the directory upperDir, whose lower
+// entry is lower, sorted by name.
+func (r *upperRoot) entries(upperDir string, lower *node) ([]fuse.DirEntry, syscall.Errno) {
+	var (
+		entries []fuse.DirEntry
+		seen    = map[string]bool{}
+	)
+	des, err := os.ReadDir(upperDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fusefs.ToErrno(err)
+	}
+	for _, de := range des {
+		name := de.Name()
+		if strings.HasPrefix(name, fs.WhiteoutPrefix) {
+			continue
+		}
+		st, ok := lstat(filepath.Join(upperDir, name))
+		if !ok {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: st.Mode, Ino: st.Ino + upperInoBase})
+	}
+
+	if lower != nil {
+		for name := range lower.children {
+			if seen[name] {
+				continue
+			}
+			child := r.lowerChild(upperDir, lower, name)
+			if info := r.contentOf(child); info != nil {
+				entries = append(entries, fuse.DirEntry{Name: name, Mode: unixMode(info.Mode), Ino: r.lowerIno(child)})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, fusefs.OK
+}
+
+// lowerIno returns the inode number of a lower entry, which is the one it
+// has in a read-only mount.
+func (r *upperRoot) lowerIno(nd *node) uint64 {
+	if target := r.tree.hardlinkTarget(nd); target != nil {
+		nd = target
+	}
+	return uint64(nd.index) + 2
+}
+
+// newChild returns the inode of a child, which is in the upper directory if
+// st is not nil, or the lower entry otherwise, and fills out.
+func (n *upperNode) newChild(ctx context.Context, st *syscall.Stat_t, lower *node, out *fuse.EntryOut) *fusefs.Inode {
+	r := n.root()
+	attr := fusefs.StableAttr{}
+	if st != nil {
+		out.Attr.FromStat(st)
+		attr.Ino = st.Ino + upperInoBase
+	} else {
+		fillAttr(&out.Attr, r.contentOf(lower), 1, r.opts)
+		if lower.children != nil {
+			out.Attr.Nlink = 2
+		}
+		attr.Ino = r.lowerIno(lower)
+	}
+	attr.Mode = out.Attr.Mode & syscall.S_IFMT
+	return n.NewInode(ctx, &upperNode{lower: lower}, attr)
+}
+
+func (n *upperNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	// Whiteouts are how the upper directory records deletions, they are
+	// not files of the mount.
+	if strings.HasPrefix(name, fs.WhiteoutPrefix) {
+		return nil, syscall.ENOENT
+	}
+	lower := n.lowerChild(name)
+	if st, ok := lstat(filepath.Join(n.path(), name)); ok {
+		return n.newChild(ctx, st, lower, out), fusefs.OK
+	}
+	if n.root().contentOf(lower) == nil {
+		return nil, syscall.ENOENT
+	}
+	return n.newChild(ctx, nil, lower, out), fusefs.OK
+}
+
+func (n *upperNode) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	entries, errno := n.root().entries(n.path(), n.lower)
+	if errno != fusefs.OK {
+		return nil, errno
+	}
+	return fusefs.NewListDirStream(entries), fusefs.OK
+}
+
+func (n *upperNode) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if st, ok := n.upperStat(); ok {
+		out.FromStat(st)
+		return fusefs.OK
+	}
+	info := n.lowerInfo()
+	if info == nil {
+		return syscall.ENOENT
+	}
+	nlink := uint32(1)
+	if info.Mode.IsDir() {
+		nlink = 2
+	}
+	fillAttr(&out.Attr, info, nlink, n.root().opts)
+	return fusefs.OK
+}
+
+func (n *upperNode) Setattr(ctx context.Context, f fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if errno := n.copyUp(); errno != fusefs.OK {
+		return errno
+	}
+	p := n.path()
+
+	if mode, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, mode); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		suid, sgid := -1, -1
+		if uok {
+			suid = int(uid)
+		}
+		if gok {
+			sgid = int(gid)
+		}
+		if err := syscall.Lchown(p, suid, sgid); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	if size, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(p, int64(size)); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		ts := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, {Nsec: unix.UTIME_OMIT}}
+		if aok {
+			ts[0] = unix.NsecToTimespec(atime.UnixNano())
+		}
+		if mok {
+			ts[1] = unix.NsecToTimespec(mtime.UnixNano())
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+func (n *upperNode) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	write := flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0
+	if _, ok := n.upperStat(); !ok && !write {
+		info := n.lowerInfo()
+		if info == nil || !info.Mode.IsRegular() {
+			return nil, 0, syscall.EINVAL
+		}
+		target := n.root().tree.hardlinkTarget(n.lower)
+		ra, err := target.layer.readerAtFor(target.info)
+		if err != nil {
+			return nil, 0, syscall.ENOENT
+		}
+		return &mountHandle{ra: ra}, 0, fusefs.OK
+	}
+
+	if errno := n.copyUp(); errno != fusefs.OK {
+		return nil, 0, errno
+	}
+	fd, err := syscall.Open(n.path(), int(flags)&^syscall.O_CREAT, 0)
+	if err != nil {
+		return nil, 0, fusefs.ToErrno(err)
+	}
+	return fusefs.NewLoopbackFile(fd), 0, fusefs.OK
+}
+
+// exists tells whether the child name is in the upper directory or the star
+// files.
+func (n *upperNode) exists(name string) bool {
+	if _, ok := lstat(filepath.Join(n.path(), name)); ok {
+		return true
+	}
+	return n.root().contentOf(n.lowerChild(name)) != nil
+}
+
+// create is like prepare, failing if the child name exists.
+func (n *upperNode) create(name string) (bool, syscall.Errno) {
+	if n.exists(name) {
+		return false, syscall.EEXIST
+	}
+	return n.prepare(name)
+}
+
+// prepare makes the directory of the node ready for the new child name: it
+// is copied up, and a whiteout of name is removed, telling whether there
+// was one.
+func (n *upperNode) prepare(name string) (bool, syscall.Errno) {
+	if strings.HasPrefix(name, fs.WhiteoutPrefix) {
+		return false, syscall.EPERM
+	}
+	if errno := n.copyUp(); errno != fusefs.OK {
+		return false, errno
+	}
+	wh := filepath.Join(n.path(), fs.WhiteoutPrefix+name)
+	if err := os.Remove(wh); err != nil {
+		if os.IsNotExist(err) {
+			return false, fusefs.OK
+		}
+		return false, fusefs.ToErrno(err)
+	}
+	return true, fusefs.OK
+}
+
+// created returns the inode of the child name just created, owned by the
+// caller, as it would be in a mount the caller could write to. Failing to
+// change the owner, e.g. without privileges, leaves it owned by the mounter.
+func (n *upperNode) created(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	p := filepath.Join(n.path(), name)
+	if caller, ok := fuse.FromContext(ctx); ok {
+		syscall.Lchown(p, int(caller.Uid), int(caller.Gid))
+	}
+	st, ok := lstat(p)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n.newChild(ctx, st, nil, out), fusefs.OK
+}
+
+func (n *upperNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	if _, errno := n.create(name); errno != fusefs.OK {
+		return nil, nil, 0, errno
+	}
+	p := filepath.Join(n.path(), name)
+	fd, err := syscall.Open(p, int(flags)|syscall.O_CREAT, mode)
+	if err != nil {
+		return nil, nil, 0, fusefs.ToErrno(err)
+	}
+	ch, errno := n.created(ctx, name, out)
+	if errno != fusefs.OK {
+		syscall.Close(fd)
+		return nil, nil, 0, errno
+	}
+	return ch, fusefs.NewLoopbackFile(fd), 0, fusefs.OK
+}
+
+func (n *upperNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	whiteout, errno := n.create(name)
+	if errno != fusefs.OK {
+		return nil, errno
+	}
+	p := filepath.Join(n.path(), name)
+	if err := syscall.Mkdir(p, mode); err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	// A directory replacing a deleted one starts empty.
+	if whiteout {
+		if err := createMarker(filepath.Join(p, fs.WhiteoutOpaque)); err != nil {
+			return nil, fusefs.ToErrno(err)
+		}
+	}
+	return n.created(ctx, name, out)
+}
+
+func (n *upperNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if _, errno := n.create(name); errno != fusefs.OK {
+		return nil, errno
+	}
+	if err := syscall.Mknod(filepath.Join(n.path(), name), mode, int(dev)); err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	return n.created(ctx, name, out)
+}
+
+func (n *upperNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if _, errno := n.create(name); errno != fusefs.OK {
+		return nil, errno
+	}
+	if err := syscall.Symlink(target, filepath.Join(n.path(), name)); err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	return n.created(ctx, name, out)
+}
+
+func (n *upperNode) Link(ctx context.Context, target fusefs.InodeEmbedder, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	tn := toUpperNode(target)
+	if errno := tn.copyUp(); errno != fusefs.OK {
+		return nil, errno
+	}
+	if _, errno := n.create(name); errno != fusefs.OK {
+		return nil, errno
+	}
+	p := filepath.Join(n.path(), name)
+	if err := syscall.Link(tn.path(), p); err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	// The link is the inode of its target in the upper directory, which
+	// the target has once mounted again, not the one it had in the star
+	// files before it was copied up.
+	st, ok := lstat(p)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n.newChild(ctx, st, nil, out), fusefs.OK
+}
+
+func (n *upperNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return n.remove(name, false)
+}
+
+func (n *upperNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return n.remove(name, true)
+}
+
+// remove deletes the child name, from the upper directory if it is there,
+// and by a whiteout if it is in the star files.
+func (n *upperNode) remove(name string, dir bool) syscall.Errno {
+	var (
+		r     = n.root()
+		p     = filepath.Join(n.path(), name)
+		lower = n.lowerChild(name)
+	)
+	st, inUpper := lstat(p)
+	info := r.contentOf(lower)
+	if !inUpper && info == nil {
+		return syscall.ENOENT
+	}
+
+	isDir := inUpper && st.Mode&syscall.S_IFMT == syscall.S_IFDIR || !inUpper && info.Mode.IsDir()
+	switch {
+	case dir && !isDir:
+		return syscall.ENOTDIR
+	case !dir && isDir:
+		return syscall.EISDIR
+	}
+	if dir {
+		entries, errno := r.entries(p, lower)
+		if errno != fusefs.OK {
+			return errno
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	if inUpper {
+		// Only whiteouts could be left in the directory.
+		if err := os.RemoveAll(p); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	if info != nil {
+		if errno := n.copyUp(); errno != fusefs.OK {
+			return errno
+		}
+		if err := createMarker(filepath.Join(n.path(), fs.WhiteoutPrefix+name)); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	return fusefs.OK
+}
+
+func (n *upperNode) Rename(ctx context.Context, name string, newParent fusefs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		return syscall.EINVAL
+	}
+	np := toUpperNode(newParent)
+	if strings.HasPrefix(newName, fs.WhiteoutPrefix) {
+		return syscall.EPERM
+	}
+
+	ch := n.GetChild(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	cn := toUpperNode(ch.Operations())
+	// The star files could not be moved in, so directories are copied up
+	// with all of their content.
+	if errno := cn.copyUp(); errno != fusefs.OK {
+		return errno
+	}
+	if err := n.root().copyUpTree(cn.path(), cn.lower); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	srcStat, _ := cn.upperStat()
+	srcDir := srcStat.Mode&syscall.S_IFMT == syscall.S_IFDIR
+
+	// Replace the destination the way remove would delete it.
+	var (
+		r        = n.root()
+		dst      = filepath.Join(np.path(), newName)
+		dstLower = np.lowerChild(newName)
+	)
+	dstStat, dstInUpper := lstat(dst)
+	if info := r.contentOf(dstLower); dstInUpper || info != nil {
+		dstDir := dstInUpper && dstStat.Mode&syscall.S_IFMT == syscall.S_IFDIR || !dstInUpper && info.Mode.IsDir()
+		switch {
+		case srcDir && !dstDir:
+			return syscall.ENOTDIR
+		case !srcDir && dstDir:
+			return syscall.EISDIR
+		}
+		if dstDir {
+			entries, errno := r.entries(dst, dstLower)
+			if errno != fusefs.OK {
+				return errno
+			}
+			if len(entries) > 0 {
+				return syscall.ENOTEMPTY
+			}
+			if dstInUpper {
+				if err := os.RemoveAll(dst); err != nil {
+					return fusefs.ToErrno(err)
+				}
+			}
+		}
+	}
+	whiteout, errno := np.prepare(newName)
+	if errno != fusefs.OK {
+		return errno
+	}
+
+	srcLower := n.lowerChild(name)
+	if err := syscall.Rename(cn.path(), dst); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	if srcDir && (whiteout || dstLower != nil) {
+		if err := createMarker(filepath.Join(dst, fs.WhiteoutOpaque)); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	if srcLower != nil {
+		if err := createMarker(filepath.Join(n.path(), fs.WhiteoutPrefix+name)); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	cn.lower = nil
+	return fusefs.OK
+}
+
+func (n *upperNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if _, ok := n.upperStat(); ok {
+		target, err := os.Readlink(n.path())
+		if err != nil {
+			return nil, fusefs.ToErrno(err)
+		}
+		return []byte(target), fusefs.OK
+	}
+	info := n.lowerInfo()
+	if info == nil || info.Mode&os.ModeSymlink == 0 {
+		return nil, syscall.EINVAL
+	}
+	return []byte(info.Linkname), fusefs.OK
+}
+
+func (n *upperNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if _, ok := n.upperStat(); ok {
+		size, err := unix.Lgetxattr(n.path(), attr, dest)
+		return uint32(size), fusefs.ToErrno(err)
+	}
+	info := n.lowerInfo()
+	if info == nil {
+		return 0, syscall.ENOENT
+	}
+	return (&mountNode{info: info}).Getxattr(ctx, attr, dest)
+}
+
+func (n *upperNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if _, ok := n.upperStat(); ok {
+		size, err := unix.Llistxattr(n.path(), dest)
+		return uint32(size), fusefs.ToErrno(err)
+	}
+	info := n.lowerInfo()
+	if info == nil {
+		return 0, syscall.ENOENT
+	}
+	return (&mountNode{info: info}).Listxattr(ctx, dest)
+}
+
+func (n *upperNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if errno := n.copyUp(); errno != fusefs.OK {
+		return errno
+	}
+	return fusefs.ToErrno(unix.Lsetxattr(n.path(), attr, data, int(flags)))
+}
+
+func (n *upperNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if errno := n.copyUp(); errno != fusefs.OK {
+		return errno
+	}
+	return fusefs.ToErrno(unix.Lremovexattr(n.path(), attr))
+}
+
+func (n *upperNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(n.root().upper, &st); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	out.FromStatfsT(&st)
+	return fusefs.OK
+}
+
+// copyUp copies the node from the star files to the upper directory unless
+// it is there, with the directories it lives in. The content of directories
+// is not copied.
+func (n *upperNode) copyUp() syscall.Errno {
+	n.copyUpMu.Lock()
+	defer n.copyUpMu.Unlock()
+	if _, ok := n.upperStat(); ok {
+		return fusefs.OK
+	}
+	if n.IsRoot() {
+		return fusefs.ToErrno(os.MkdirAll(n.root().upper, 0755))
+	}
+	_, parent := n.Parent()
+	if parent == nil {
+		return syscall.ENOENT
+	}
+	if errno := toUpperNode(parent.Operations()).copyUp(); errno != fusefs.OK {
+		return errno
+	}
+	info := n.lowerInfo()
+	if info == nil {
+		return syscall.ENOENT
+	}
+	if err := n.root().copyUpInfo(n.path(), n.lower, info); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	return fusefs.OK
+}
+
+// copyUpTree copies the lower entries of the directory upperDir, whose lower
+// entry is lower, to the upper directory, recursively.
+func (r *upperRoot) copyUpTree(upperDir string, lower *node) error {
+	if lower == nil || lower.children == nil {
+		return nil
+	}
+	for name := range lower.children {
+		child := r.lowerChild(upperDir, lower, name)
+		info := r.contentOf(child)
+		if info == nil {
+			continue
+		}
+		p := filepath.Join(upperDir, name)
+		st, ok := lstat(p)
+		if !ok {
+			if err := r.copyUpInfo(p, child, info); err != nil {
+				return err
+			}
+		} else if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		if err := r.copyUpTree(p, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUpInfo creates p as the file info of the lower entry nd, unless p is
+// there already. Regular files are written aside and renamed to p once
+// complete, so p never holds part of the content, nor is replaced.
+func (r *upperRoot) copyUpInfo(p string, nd *node, info *Info) error {
+	var (
+		dst = p
+		err error
+	)
+	switch {
+	case info.Mode.IsDir():
+		err = syscall.Mkdir(p, uint32(info.Mode.Perm()))
+	case info.Mode&os.ModeSymlink != 0:
+		err = syscall.Symlink(info.Linkname, p)
+	case info.Mode.IsRegular():
+		dst, err = r.copyUpContent(filepath.Dir(p), nd, info)
+	default:
+		err = syscall.Mknod(p, unixMode(info.Mode), int(mkdev(info.Major, info.Minor)))
+	}
+	if err == syscall.EEXIST {
+		// Copied up meanwhile, by copyUp of the node racing copyUpTree of a
+		// directory it lives in, the copy there, maybe written since, wins.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Ownership, xattrs and times are kept where permitted, the content is
+	// what matters. The owner goes first, changing it clears setuid bits.
+	syscall.Lchown(dst, int(r.opts.UIDMap.Map(info.Uid)), int(r.opts.GIDMap.Map(info.Gid)))
+	if info.Mode&os.ModeSymlink == 0 {
+		syscall.Chmod(dst, unixMode(info.Mode)&^syscall.S_IFMT)
+	}
+	for key, value := range info.Xattrs {
+		unix.Lsetxattr(dst, key, []byte(value), 0)
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(info.Atime.UnixNano()),
+		unix.NsecToTimespec(info.Mtime.UnixNano()),
+	}
+	unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW)
+	if dst != p {
+		err := unix.Renameat2(unix.AT_FDCWD, dst, unix.AT_FDCWD, p, unix.RENAME_NOREPLACE)
+		if err == unix.EINVAL {
+			// The upper directory is on a filesystem without RENAME_NOREPLACE.
+			err = os.Rename(dst, p)
+		}
+		if err != nil {
+			os.Remove(dst)
+			if err == unix.EEXIST {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUpTempPrefix prefixes the files content is copied up to, a whiteout
+// prefix, so they are never listed in the mount.
+const copyUpTempPrefix = fs.WhiteoutPrefix + fs.WhiteoutPrefix + "copyup-"
+
+// copyUpContent writes the content of the regular file info, the lower entry
+// nd, to a new file in the directory dir, returning its path. The file is
+// removed if it fails.
+func (r *upperRoot) copyUpContent(dir string, nd *node, info *Info) (string, error) {
+	target := r.tree.hardlinkTarget(nd)
+	if target == nil || target.layer == nil {
+		// A hard link whose target is missing in the star files.
+		return "", syscall.ENOENT
+	}
+	ra, err := target.layer.readerAtFor(target.info)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, copyUpTempPrefix)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(ra, 0, int64(info.Size)))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// createMarker creates an empty whiteout or opaque marker.
+func createMarker(name string) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
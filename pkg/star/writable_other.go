@@ -0,0 +1,15 @@
+// +build !linux
+
+package star
+
+import (
+	"errors"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+)
+
+// newUpperRoot fails, as writable mounts copy up and record whiteouts with
+// linux syscalls.
+func newUpperRoot(tree *dirTree, opts *MountOptions) (fusefs.InodeEmbedder, error) {
+	return nil, errors.New("writable mounts are only supported on linux")
+}
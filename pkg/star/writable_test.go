@@ -0,0 +1,224 @@
+// +build linux
+
+package star
+
+import (
+	"bytes"
+	iofs "io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// writableTestFiles returns the files of the star file under writable mounts.
+func writableTestFiles() []testFile {
+	file := func(name string, mode os.FileMode, data string) testFile {
+		return testFile{FileInfo: fs.FileInfo{Name: name, Mode: mode}, data: data}
+	}
+	return []testFile{
+		file("etc", os.ModeDir|0755, ""),
+		file("etc/hosts", 0644, "127.0.0.1 localhost\n"),
+		file("etc/passwd", 0600, "root:x:0:0::/root:/bin/sh\n"),
+		file("etc/sub", os.ModeDir|0755, ""),
+		file("etc/sub/f", 0644, "f"),
+		file("etc/link", os.ModeSymlink|0777, ""),
+		file("bin", os.ModeDir|0755, ""),
+		file("bin/sh", 0755, "#!sh"),
+	}
+}
+
+// mountTestUpper mounts the star file of files writable over a new upper
+// dir, returning the mountpoint, the upper dir and the star file.
+func mountTestUpper(t *testing.T, files []testFile) (string, string, *Reader) {
+	t.Helper()
+	sr, err := NewReader(bytes.NewReader(writeTestStar(t, files, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt, upper := t.TempDir(), t.TempDir()
+	server, err := NewMountServer(mnt, sr, &MountOptions{Upper: upper})
+	if err != nil {
+		t.Skip("no fuse,", err)
+	}
+	t.Cleanup(func() {
+		if err := server.Unmount(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mnt, upper, sr
+}
+
+// snapshot returns the files of fsys, with the content of regular files.
+func snapshot(t *testing.T, fsys iofs.FS) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := iofs.WalkDir(fsys, ".", func(name string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			files[name] = "dir"
+		case d.Type()&iofs.ModeSymlink != 0:
+			files[name] = "symlink"
+		default:
+			data, err := iofs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			files[name] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// checkUpper checks the names in the upper dir are want, whiteouts included.
+func checkUpper(t *testing.T, upper string, want ...string) {
+	t.Helper()
+	var got []string
+	filepath.Walk(upper, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && p != upper {
+			rel, _ := filepath.Rel(upper, p)
+			got = append(got, rel)
+		}
+		return nil
+	})
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("upper dir, want %q, got %q", want, got)
+	}
+}
+
+// checkCommit checks the upper dir, read as a layer as star commit does,
+// merged over sr is what the mount shows.
+func checkCommit(t *testing.T, mnt, upper string, sr *Reader) {
+	t.Helper()
+	ur, err := fs.NewUpperReader(upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTo(&buf, ur); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := snapshot(t, os.DirFS(mnt)), snapshot(t, NewLayeredReader(sr, layer))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("committed layer over the star file, want %q, got %q", want, got)
+	}
+}
+
+func TestWritableCopyUp(t *testing.T) {
+	mnt, upper, sr := mountTestUpper(t, writableTestFiles())
+
+	f, err := os.OpenFile(filepath.Join(mnt, "etc/hosts"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("::1 localhost\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(upper, "etc/hosts"))
+	if want := "127.0.0.1 localhost\n::1 localhost\n"; err != nil || string(data) != want {
+		t.Errorf("copied up etc/hosts, want %q, got %q %v", want, data, err)
+	}
+	if st, err := os.Lstat(filepath.Join(upper, "etc/hosts")); err != nil || st.Mode() != 0644 {
+		t.Errorf("mode of copied up etc/hosts, want 0644, got %v", err)
+	}
+	// Only the file and its directory are copied up.
+	checkUpper(t, upper, "etc", "etc/hosts")
+	// The star file is read-only.
+	if data, err := sr.ReadFile("etc/hosts"); err != nil || string(data) != "127.0.0.1 localhost\n" {
+		t.Errorf("etc/hosts of the star file, got %q %v", data, err)
+	}
+	checkCommit(t, mnt, upper, sr)
+}
+
+func TestWritableUnlink(t *testing.T) {
+	mnt, upper, sr := mountTestUpper(t, writableTestFiles())
+
+	if err := os.Remove(filepath.Join(mnt, "etc/passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(mnt, "etc/sub")); err != nil {
+		t.Fatal(err)
+	}
+	// A file only in the upper dir leaves no whiteout.
+	if err := ioutil.WriteFile(filepath.Join(mnt, "bin/new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(mnt, "bin/new")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"etc/passwd", "etc/sub", "etc/sub/f"} {
+		if _, err := os.Lstat(filepath.Join(mnt, name)); !os.IsNotExist(err) {
+			t.Errorf("%q deleted, want not found, got %v", name, err)
+		}
+	}
+	checkUpper(t, upper, "bin", "etc", "etc/.wh.passwd", "etc/.wh.sub")
+	checkCommit(t, mnt, upper, sr)
+}
+
+func TestWritableRename(t *testing.T) {
+	mnt, upper, sr := mountTestUpper(t, writableTestFiles())
+
+	// Over a file of the star file.
+	if err := os.Rename(filepath.Join(mnt, "etc/hosts"), filepath.Join(mnt, "etc/passwd")); err != nil {
+		t.Fatal(err)
+	}
+	// A directory of the star file, copied up with its content.
+	if err := os.Rename(filepath.Join(mnt, "etc/sub"), filepath.Join(mnt, "bin/sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(mnt, "etc/passwd"))
+	if err != nil || string(data) != "127.0.0.1 localhost\n" {
+		t.Errorf("etc/passwd renamed over, got %q %v", data, err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(mnt, "bin/sub/f"))
+	if err != nil || string(data) != "f" {
+		t.Errorf("bin/sub/f renamed, got %q %v", data, err)
+	}
+	checkUpper(t, upper, "bin", "bin/sub", "bin/sub/f", "etc", "etc/.wh.hosts", "etc/.wh.sub", "etc/passwd")
+	checkCommit(t, mnt, upper, sr)
+}
+
+func TestWritableMkdirOpaque(t *testing.T) {
+	mnt, upper, sr := mountTestUpper(t, writableTestFiles())
+
+	if err := os.RemoveAll(filepath.Join(mnt, "etc/sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(mnt, "etc/sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mnt, "etc/sub/g"), []byte("g"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory replacing the deleted one hides its content.
+	des, err := os.ReadDir(filepath.Join(mnt, "etc/sub"))
+	if err != nil || len(des) != 1 || des[0].Name() != "g" {
+		t.Errorf("etc/sub recreated, want g only, got %v %v", des, err)
+	}
+	checkUpper(t, upper, "etc", "etc/sub", "etc/sub/.wh..wh..opq", "etc/sub/g")
+	checkCommit(t, mnt, upper, sr)
+}
@@ -1,98 +1,490 @@
 package star
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"sort"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
 
 	"github.com/sequix/star/pkg/encoding"
 	"github.com/sequix/star/pkg/fs"
 )
 
-const (
-	Magic    = 0xab72617473cd
-	Version1 = 0x00
+// dedupBufferSize is the size of the largest file buffered in memory for
+// dedup, if its data could not seek back after being hashed. Larger files are
+// spooled to a temporary file.
+const dedupBufferSize = 4 << 20
+
+var (
+	ErrWriteTooLong    = errors.New("star: write too long")
+	ErrWriteAfterClose = errors.New("star: write after close")
 )
 
-// <magic>(8) <version>(1) <payload-length>(8) <info-length>(4)
-// <payload1> <payload2> ... <payloadN>
-// <Info1> <Info2> .... <InfoN>
-func WriteTo(w io.WriterAt, fsr fs.Reader) error {
-	var (
-		infos   []*Info
-		infoBuf = make([]byte, 0, 128)
-		offset  = uint64(8 + 1 + 8 + 8)
-		wto     = &writerToOffset{w: w}
-	)
+// WriteTo writes all files of fsr to w as a star file.
+func WriteTo(w io.Writer, fsr fs.Reader) error {
+	sw := NewWriter(w)
+	if err := sw.WriteFiles(fsr); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// Writer writes a star file sequentially, like archive/tar.Writer. Call
+// WriteHeader to begin a new file, then Write to supply its content.
+//
+// It always writes the LatestVersion, see format.go for the layout.
+type Writer struct {
+	w      io.Writer
+	offset uint64
+	infos  []*Info
+	// Infos of regular files and hard links by cleaned name, to resolve
+	// the payload of hard links.
+	regulars map[string]*Info
+	// Bytes left of the payload of current file.
+	remaining uint64
+	// Digest of the payload of current file.
+	digestAlg string
+	newHash   func() hash.Hash
+	hash      hash.Hash
+	// Files by digest of their content, to share content of later files
+	// having the same digest.
+	dedup   bool
+	digests map[string]*Info
+	// Compression of following files, nil if stored as is.
+	comp      Compressor
+	compAlg   string
+	chunkSize int
+	// Uncompressed and compressed current chunk.
+	chunkBuf []byte
+	compBuf  []byte
+	infoBuf  []byte
+	// Offset the payloads of hot files end at, 0 if not marked.
+	hotEnd uint64
+	closed bool
+	err    error
+}
+
+// NewWriter returns a Writer writing a star file to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:         w,
+		regulars:  map[string]*Info{},
+		dedup:     true,
+		digests:   map[string]*Info{},
+		digestAlg: DefaultDigestAlgorithm,
+		newHash:   sha256.New,
+		infoBuf:   make([]byte, 0, 128),
+	}
+}
 
-	n, err := w.WriteAt(encoding.PutUint64(nil, Magic), 0)
+// SetDigestAlgorithm changes the algorithm the digests of following files
+// are computed with, see RegisterDigestAlgorithm. An empty algorithm turns
+// digests off.
+func (w *Writer) SetDigestAlgorithm(algorithm string) error {
+	if len(algorithm) == 0 {
+		w.digestAlg, w.newHash = "", nil
+		return nil
+	}
+	newHash, err := digester(algorithm)
 	if err != nil {
-		return fmt.Errorf("writing star magic, written %d bytes, err %w", n, err)
+		return err
 	}
-	n, err = w.WriteAt([]byte{Version1}, 8)
+	w.digestAlg, w.newHash = algorithm, newHash
+	return nil
+}
+
+// SetDedup turns dedup on or off, which is on by default. With dedup, files
+// having the same digest share one copy of content, so it needs digests on.
+func (w *Writer) SetDedup(dedup bool) {
+	w.dedup = dedup
+}
+
+// SetCompression compresses the payload of following files with algorithm,
+// in chunks of chunkSize uncompressed bytes, see RegisterCompression. An
+// empty algorithm turns compression off.
+func (w *Writer) SetCompression(algorithm string, chunkSize int) error {
+	if len(algorithm) == 0 {
+		w.comp, w.compAlg = nil, ""
+		return nil
+	}
+	if chunkSize <= 0 || chunkSize > math.MaxUint32 {
+		return fmt.Errorf("chunk size want within (0, %d], got %d", uint32(math.MaxUint32), chunkSize)
+	}
+	c, err := compressor(algorithm)
 	if err != nil {
-		return fmt.Errorf("writing star vetsion, written %d bytes, err %w", n, err)
+		return err
 	}
+	w.comp, w.compAlg, w.chunkSize = c, algorithm, chunkSize
+	return nil
+}
 
+// WriteFiles writes all files of fsr.
+func (w *Writer) WriteFiles(fsr fs.Reader) error {
 	for {
 		f, err := fsr.Next()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				break
+				return nil
 			}
 			return fmt.Errorf("reading next file, %w", err)
 		}
 
-		info := &Info{
-			FileInfo: &f.FileInfo,
-			Offset:   offset,
+		if f.Data == nil {
+			if err := w.WriteHeader(&f.FileInfo); err != nil {
+				return err
+			}
+			continue
+		}
+		err = w.writeFile(f)
+		f.Data.Close()
+		if err != nil {
+			return err
 		}
-		infos = append(infos, info)
+	}
+}
 
-		if !info.Mode.IsRegular() {
-			continue
+// writeFile writes a regular file, sharing the content of an earlier file
+// with the same digest if dedup is on. The digest is computed ahead by seeking
+// back if the data could, or by buffering the data, in memory if it is small
+// enough, or else in a temporary file.
+func (w *Writer) writeFile(f *fs.File) error {
+	var data io.Reader = f.Data
+
+	if w.dedup && w.newHash != nil && f.Size > 0 {
+		h := w.newHash()
+		rs, seekable := f.Data.(io.ReadSeeker)
+		switch {
+		case seekable:
+			if _, err := io.Copy(h, rs); err != nil {
+				return fmt.Errorf("hashing file %q, %w", f.Name, err)
+			}
+			if _, err := rs.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("seeking file %q, %w", f.Name, err)
+			}
+		case f.Size <= dedupBufferSize:
+			buf, err := ioutil.ReadAll(f.Data)
+			if err != nil {
+				return fmt.Errorf("reading file %q, %w", f.Name, err)
+			}
+			h.Write(buf)
+			data = bytes.NewReader(buf)
+		default:
+			tf, err := spool(io.TeeReader(f.Data, h))
+			if err != nil {
+				return fmt.Errorf("spooling file %q, %w", f.Name, err)
+			}
+			defer os.Remove(tf.Name())
+			defer tf.Close()
+			data = tf
 		}
 
-		wto.offset = int64(offset)
-		if n, err := io.Copy(wto, f.Data); err != nil {
-			return fmt.Errorf("copying file %q to offset %d, written %d, err %w", f.Name, offset, n, err)
+		dup, err := w.WriteHeaderDigest(&f.FileInfo, formatDigest(w.digestAlg, h))
+		if err != nil || dup {
+			return err
 		}
-		offset += f.Size
+		return w.copyFrom(f.Name, data)
+	}
+
+	if err := w.WriteHeader(&f.FileInfo); err != nil {
+		return err
+	}
+	return w.copyFrom(f.Name, data)
+}
+
+// spool copies r to a new temporary file, returned at its start.
+func spool(r io.Reader) (*os.File, error) {
+	tf, err := ioutil.TempFile("", "star-spool-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(tf, r); err == nil {
+		_, err = tf.Seek(0, io.SeekStart)
 	}
+	if err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return nil, err
+	}
+	return tf, nil
+}
 
-	payloadLength := offset - 21
-	n, err = w.WriteAt(encoding.PutUint64(nil, payloadLength), 9)
+func (w *Writer) copyFrom(name string, data io.Reader) error {
+	n, err := io.Copy(w, data)
 	if err != nil {
-		return fmt.Errorf("writing payload length %d, written %d, err %w", payloadLength, n, err)
+		return fmt.Errorf("copying file %q, written %d, err %w", name, n, err)
+	}
+	return nil
+}
+
+// WriteHeaderDigest is like WriteHeader, for a regular file whose content has
+// digest, formatted like Info.Digest. If dedup is on and an earlier file has
+// the same content, the file shares it, true is returned, and its content
+// must not be written.
+func (w *Writer) WriteHeaderDigest(fi *fs.FileInfo, digest string) (bool, error) {
+	target, ok := w.digests[digest]
+	if !w.dedup || !ok || !fi.Mode.IsRegular() || fi.Kind != fs.KindNormal || fi.Size != target.Size {
+		return false, w.WriteHeader(fi)
+	}
+	if err := w.beginHeader(); err != nil {
+		return false, err
 	}
 
-	offsetBeforeInfo := offset
-	for _, info := range infos {
-		infoBuf = marshalInfoTo(infoBuf[:0], info)
-		n, err = w.WriteAt(infoBuf, int64(offset))
+	fic := *fi
+	trimNames(&fic)
+	info := &Info{
+		FileInfo: &fic,
+		Offset:   target.Offset,
+		Digest:   target.Digest,
+		Chunks:   target.Chunks,
+	}
+	w.regulars[CleanName(info.Name)] = info
+	w.infos = append(w.infos, info)
+	return true, nil
+}
+
+// WriteHeader begins a new file described by fi. Size bytes should be written
+// after it, if fi is a regular file which is not a hard link.
+func (w *Writer) WriteHeader(fi *fs.FileInfo) error {
+	return w.writeInfo(fi, nil)
+}
+
+// writeInfo is WriteHeader, a hard link sharing the content of target if not
+// nil, rather than of the last file written named as its Linkname.
+func (w *Writer) writeInfo(fi *fs.FileInfo, target *Info) error {
+	if err := w.beginHeader(); err != nil {
+		return err
+	}
+
+	fic := *fi
+	trimNames(&fic)
+	info := &Info{
+		FileInfo: &fic,
+		Offset:   w.offset,
+	}
+
+	if info.Kind == fs.KindHardlink {
+		if target == nil {
+			var ok bool
+			if target, ok = w.regulars[CleanName(info.Linkname)]; !ok {
+				return fmt.Errorf("hard link %q to %q, target not found before it", info.Name, info.Linkname)
+			}
+		}
+		info.Offset, info.Size = target.Offset, target.Size
+		info.Digest, info.Chunks = target.Digest, target.Chunks
+		w.regulars[CleanName(info.Name)] = info
+	} else if info.Kind == fs.KindNormal && info.Mode.IsRegular() {
+		w.regulars[CleanName(info.Name)] = info
+		w.remaining = info.Size
+		if w.comp != nil && info.Size > 0 {
+			info.Chunks = &ChunkTable{
+				Compression: w.compAlg,
+				ChunkSize:   uint32(w.chunkSize),
+				Offsets:     []uint64{0},
+			}
+		}
+		if w.newHash != nil {
+			if info.Size == 0 {
+				info.Digest = formatDigest(w.digestAlg, w.newHash())
+			} else {
+				w.hash = w.newHash()
+			}
+		}
+	}
+	w.infos = append(w.infos, info)
+	return nil
+}
+
+// trimNames strips leading "/" of the name of fi, and of the target of a
+// hard link, as tar does, so absolute names are extracted beneath the
+// extraction root. Symlinks point where archived.
+func trimNames(fi *fs.FileInfo) {
+	fi.Name = trimLeadingSlash(fi.Name)
+	if fi.Kind == fs.KindHardlink {
+		fi.Linkname = trimLeadingSlash(fi.Linkname)
+	}
+}
+
+func trimLeadingSlash(name string) string {
+	if name = strings.TrimLeft(name, "/"); len(name) == 0 {
+		return "."
+	}
+	return name
+}
+
+func (w *Writer) beginHeader() error {
+	if err := w.check(); err != nil {
+		return err
+	}
+	if w.remaining > 0 {
+		return w.fail(fmt.Errorf("star: missed %d bytes of %q", w.remaining, w.infos[len(w.infos)-1].Name))
+	}
+	// Only the content of the file begun is hashed.
+	w.hash = nil
+	if w.offset == 0 {
+		return w.writeHeader()
+	}
+	return nil
+}
+
+// Write writes the content of current file, returning ErrWriteTooLong if
+// more than its Size is written, or no file is begun.
+func (w *Writer) Write(p []byte) (int, error) {
+	if err := w.check(); err != nil {
+		return 0, err
+	}
+	if len(w.infos) == 0 {
+		return 0, ErrWriteTooLong
+	}
+	tooLong := false
+	if uint64(len(p)) > w.remaining {
+		p = p[:w.remaining]
+		tooLong = true
+	}
+
+	var (
+		n    int
+		err  error
+		info = w.infos[len(w.infos)-1]
+	)
+	if info.Chunks != nil {
+		n, err = w.writeChunked(info, p)
+	} else {
+		n, err = w.write(p)
+	}
+	w.remaining -= uint64(n)
+
+	if w.hash != nil {
+		w.hash.Write(p[:n])
+		if w.remaining == 0 {
+			info.Digest = formatDigest(w.digestAlg, w.hash)
+			if _, ok := w.digests[info.Digest]; !ok {
+				w.digests[info.Digest] = info
+			}
+			w.hash = nil
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	if tooLong {
+		return n, ErrWriteTooLong
+	}
+	return n, nil
+}
+
+// writeChunked buffers p into chunks, writing the compressed chunk once full
+// or the file ends.
+func (w *Writer) writeChunked(info *Info, p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		nn := w.chunkSize - len(w.chunkBuf)
+		if nn > len(p)-n {
+			nn = len(p) - n
+		}
+		w.chunkBuf = append(w.chunkBuf, p[n:n+nn]...)
+		n += nn
+
+		if len(w.chunkBuf) < w.chunkSize && uint64(n) < w.remaining {
+			continue
+		}
+
+		var err error
+		w.compBuf, err = w.comp.Compress(w.compBuf[:0], w.chunkBuf)
 		if err != nil {
+			return n, w.fail(fmt.Errorf("compressing chunk of %q, %w", info.Name, err))
+		}
+		if _, err := w.write(w.compBuf); err != nil {
+			return n, err
+		}
+		t := info.Chunks
+		t.Offsets = append(t.Offsets, w.offset-info.Offset)
+		w.chunkBuf = w.chunkBuf[:0]
+	}
+	return n, nil
+}
+
+// MarkHotEnd marks the payloads written so far as those of hot files, which
+// are needed first, e.g. when a container starts. Readers could fetch the star
+// file up to the mark in one request, see Reader.HotEnd.
+func (w *Writer) MarkHotEnd() error {
+	if err := w.beginHeader(); err != nil {
+		return err
+	}
+	w.hotEnd = w.offset
+	return nil
+}
+
+// Close writes the infos and the footer. It does not close the underlying
+// io.Writer.
+func (w *Writer) Close() error {
+	if err := w.check(); err != nil {
+		return err
+	}
+	if w.remaining > 0 {
+		return w.fail(fmt.Errorf("star: missed %d bytes of %q", w.remaining, w.infos[len(w.infos)-1].Name))
+	}
+	// Only the content of the file begun is hashed.
+	w.hash = nil
+	if w.offset == 0 {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	infoOffset := w.offset
+	for _, info := range w.infos {
+		w.infoBuf = marshalInfoTo(w.infoBuf[:0], info)
+		if n, err := w.write(w.infoBuf); err != nil {
 			return fmt.Errorf("writing info for %q, written %d, err %w", info.Name, n, err)
 		}
-		offset += uint64(len(infoBuf))
 	}
 
-	infoLength := offset - offsetBeforeInfo
-	sort.Slice(infos, func(i, j int) bool {
-		return infos[i].Name < infos[j].Name
-	})
-	n, err = w.WriteAt(encoding.PutUint32(nil, uint32(infoLength)), 17)
-	if err != nil {
-		return fmt.Errorf("writing info length %d, written %d, err %w", infoLength, n, err)
+	infoLength := w.offset - infoOffset
+	footer := encoding.PutUint64(w.infoBuf[:0], infoOffset)
+	footer = encoding.PutUint64(footer, infoLength)
+	footer = encoding.PutUint64(footer, w.hotEnd)
+	footer = encoding.PutUint64(footer, Magic)
+	if n, err := w.write(footer); err != nil {
+		return fmt.Errorf("writing footer, written %d, err %w", n, err)
 	}
+	w.closed = true
 	return nil
 }
 
-type writerToOffset struct {
-	w      io.WriterAt
-	offset int64
+func (w *Writer) writeHeader() error {
+	header := encoding.PutUint64(w.infoBuf[:0], Magic)
+	header = append(header, LatestVersion)
+	header = append(header, make([]byte, headerReservedLen)...)
+	if n, err := w.write(header); err != nil {
+		return fmt.Errorf("writing star header, written %d bytes, err %w", n, err)
+	}
+	return nil
+}
+
+func (w *Writer) write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.offset += uint64(n)
+	if err != nil {
+		w.fail(err)
+	}
+	return n, err
+}
+
+func (w *Writer) check() error {
+	if w.closed {
+		return ErrWriteAfterClose
+	}
+	return w.err
 }
 
-func (w *writerToOffset) Write(p []byte) (n int, err error) {
-	return w.w.WriteAt(p, w.offset)
+// fail makes all following calls to return err, as the star file is broken.
+func (w *Writer) fail(err error) error {
+	w.err = err
+	return err
 }
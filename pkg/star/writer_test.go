@@ -0,0 +1,284 @@
+package star
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sequix/star/pkg/fs"
+)
+
+// testFile is a file of the star files written by tests.
+type testFile struct {
+	fs.FileInfo
+	data string
+}
+
+// sliceReader reads the files of a slice.
+type sliceReader struct {
+	files []testFile
+}
+
+func (r *sliceReader) Next() (*fs.File, error) {
+	if len(r.files) == 0 {
+		return nil, io.EOF
+	}
+	tf := r.files[0]
+	r.files = r.files[1:]
+	f := &fs.File{FileInfo: tf.FileInfo}
+	if tf.Mode.IsRegular() && tf.Kind == fs.KindNormal {
+		f.Size = uint64(len(tf.data))
+		f.Data = ioutil.NopCloser(strings.NewReader(tf.data))
+	}
+	return f, nil
+}
+
+// testFiles returns files of every kind, with content large enough to span
+// several chunks of testChunkSize.
+func testFiles() []testFile {
+	mtime := time.Unix(1600000000, 123)
+	fi := func(name string, mode os.FileMode) fs.FileInfo {
+		return fs.FileInfo{
+			Name:  name,
+			Mode:  mode,
+			Uid:   1000,
+			Gid:   100,
+			Mtime: mtime,
+			Atime: mtime.Add(time.Second),
+			Ctime: mtime.Add(2 * time.Second),
+		}
+	}
+	big := strings.Repeat("0123456789abcdef", 1000)
+
+	files := []testFile{
+		{FileInfo: fi("etc", os.ModeDir|0755)},
+		{FileInfo: fi("etc/hosts", 0644), data: "127.0.0.1 localhost\n"},
+		{FileInfo: fi("etc/empty", 0600)},
+		{FileInfo: fi("etc/big", 0644), data: big},
+		// Same content as etc/big, shared with dedup.
+		{FileInfo: fi("etc/big.copy", 0644), data: big},
+		{FileInfo: fi("etc/link", os.ModeSymlink|0777)},
+		{FileInfo: fi("etc/hard", 0644)},
+		{FileInfo: fi("dev", os.ModeDir|0755)},
+		{FileInfo: fi("dev/null", os.ModeDevice|os.ModeCharDevice|0666)},
+		{FileInfo: fi("bin", os.ModeDir|os.ModeSticky|0755)},
+		{FileInfo: fi("bin/su", os.ModeSetuid|0755), data: "#!/bin/sh\n"},
+	}
+	files[5].Linkname = "hosts"
+	files[6].Kind, files[6].Linkname = fs.KindHardlink, "etc/hosts"
+	files[8].Major, files[8].Minor = 1, 3
+	files[10].Xattrs = map[string]string{"security.capability": "\x01\x00"}
+	return files
+}
+
+// testChunkSize is small, so the files of testFiles span several chunks.
+const testChunkSize = 4096
+
+// writeTestStar writes files to a star file with the Writer set by setup.
+func writeTestStar(t *testing.T, files []testFile, setup func(*Writer)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	sw := NewWriter(&buf)
+	if setup != nil {
+		setup(sw)
+	}
+	if err := sw.WriteFiles(&sliceReader{files: files}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// checkTestStar checks the star file data holds files, with their content.
+func checkTestStar(t *testing.T, data []byte, files []testFile) *Reader {
+	t.Helper()
+	sr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := sr.ListFiles()
+	if len(infos) != len(files) {
+		t.Fatalf("want %d files, got %d", len(files), len(infos))
+	}
+
+	contents := map[string]string{}
+	for i, tf := range files {
+		info := infos[i]
+		if info.Name != tf.Name || info.Mode != tf.Mode || info.Kind != tf.Kind || info.Linkname != tf.Linkname ||
+			info.Uid != tf.Uid || info.Gid != tf.Gid || info.Major != tf.Major || info.Minor != tf.Minor {
+			t.Errorf("file %d, want %+v, got %+v", i, tf.FileInfo, *info.FileInfo)
+		}
+		if !info.Mtime.Equal(tf.Mtime) || !info.Atime.Equal(tf.Atime) || !info.Ctime.Equal(tf.Ctime) {
+			t.Errorf("times of %q, want %s %s %s, got %s %s %s", tf.Name,
+				tf.Mtime, tf.Atime, tf.Ctime, info.Mtime, info.Atime, info.Ctime)
+		}
+		for key, value := range tf.Xattrs {
+			if info.Xattrs[key] != value {
+				t.Errorf("xattr %q of %q, want %q, got %q", key, tf.Name, value, info.Xattrs[key])
+			}
+		}
+
+		want := tf.data
+		if tf.Kind == fs.KindHardlink {
+			want = contents[tf.Linkname]
+		}
+		contents[tf.Name] = want
+		if !tf.Mode.IsRegular() {
+			continue
+		}
+		if info.Size != uint64(len(want)) {
+			t.Errorf("size of %q, want %d, got %d", tf.Name, len(want), info.Size)
+		}
+		fr, err := sr.ReaderForInfo(info)
+		if err != nil {
+			t.Errorf("reading %q, %s", tf.Name, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Errorf("reading %q, %s", tf.Name, err)
+		} else if string(got) != want {
+			t.Errorf("content of %q, want %d bytes, got %d bytes differing", tf.Name, len(want), len(got))
+		}
+	}
+	return sr
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(*Writer)
+	}{
+		{"plain", nil},
+		{"nodedup", func(w *Writer) { w.SetDedup(false) }},
+		{"nodigest", func(w *Writer) { w.SetDigestAlgorithm("") }},
+		{"gzip", func(w *Writer) { w.SetCompression("gzip", testChunkSize) }},
+		{"zstd", func(w *Writer) { w.SetCompression("zstd", testChunkSize) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := testFiles()
+			sr := checkTestStar(t, writeTestStar(t, files, tc.setup), files)
+			if sr.Version() != LatestVersion {
+				t.Errorf("want version %d, got %d", LatestVersion+1, sr.Version()+1)
+			}
+		})
+	}
+}
+
+func TestWriterDedup(t *testing.T) {
+	files := testFiles()
+	data := writeTestStar(t, files, nil)
+	nodedup := writeTestStar(t, files, func(w *Writer) { w.SetDedup(false) })
+	if len(data) >= len(nodedup) {
+		t.Errorf("want deduped star file smaller than %d bytes, got %d bytes", len(nodedup), len(data))
+	}
+
+	sr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big, _ := sr.infoFor("etc/big")
+	copy, _ := sr.infoFor("etc/big.copy")
+	if big.Offset != copy.Offset {
+		t.Errorf("want etc/big.copy sharing offset %d, got %d", big.Offset, copy.Offset)
+	}
+}
+
+func TestWriterDedupSpooled(t *testing.T) {
+	big := strings.Repeat("x", dedupBufferSize+1)
+	files := []testFile{
+		{FileInfo: fs.FileInfo{Name: "a", Mode: 0644}, data: big},
+		{FileInfo: fs.FileInfo{Name: "b", Mode: 0644}, data: big},
+	}
+	var buf bytes.Buffer
+	sw := NewWriter(&buf)
+	if err := sw.WriteFiles(&sliceReader{files: files}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 2*dedupBufferSize {
+		t.Errorf("want files larger than %d bytes deduped, got a star file of %d bytes", dedupBufferSize, buf.Len())
+	}
+
+	sr, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		fr, err := sr.ReaderFor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != big {
+			t.Errorf("content of %q differs, %d bytes", name, len(content))
+		}
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	sw := NewWriter(ioutil.Discard)
+	if _, err := sw.Write([]byte("x")); err != ErrWriteTooLong {
+		t.Errorf("write before header, want %v, got %v", ErrWriteTooLong, err)
+	}
+
+	if err := sw.WriteHeader(&fs.FileInfo{Name: "f", Mode: 0644, Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sw.Write([]byte("xy")); n != 1 || err != ErrWriteTooLong {
+		t.Errorf("write beyond size, want 1 %v, got %d %v", ErrWriteTooLong, n, err)
+	}
+	if err := sw.WriteHeader(&fs.FileInfo{Name: "h", Kind: fs.KindHardlink, Linkname: "missing"}); err == nil {
+		t.Errorf("hard link to missing target, want error")
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write(nil); err != ErrWriteAfterClose {
+		t.Errorf("write after close, want %v, got %v", ErrWriteAfterClose, err)
+	}
+
+	sw = NewWriter(ioutil.Discard)
+	if err := sw.WriteHeader(&fs.FileInfo{Name: "f", Mode: 0644, Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err == nil || errors.Is(err, ErrWriteAfterClose) {
+		t.Errorf("close with content missing, want error, got %v", err)
+	}
+}
+
+func TestWriterAbsoluteNames(t *testing.T) {
+	files := []testFile{
+		{FileInfo: fs.FileInfo{Name: "/", Mode: os.ModeDir | 0755}},
+		{FileInfo: fs.FileInfo{Name: "/etc", Mode: os.ModeDir | 0755}},
+		{FileInfo: fs.FileInfo{Name: "//etc/hosts", Mode: 0644, Size: 2}, data: "hi"},
+		{FileInfo: fs.FileInfo{Name: "/etc/hard", Kind: fs.KindHardlink, Linkname: "/etc/hosts"}},
+		{FileInfo: fs.FileInfo{Name: "/etc/link", Mode: os.ModeSymlink | 0777, Linkname: "/etc/hosts"}},
+	}
+	sr, err := NewReader(bytes.NewReader(writeTestStar(t, files, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, linknames []string
+	for _, fi := range sr.ListFiles() {
+		names, linknames = append(names, fi.Name), append(linknames, fi.Linkname)
+	}
+	wantNames := []string{".", "etc", "etc/hosts", "etc/hard", "etc/link"}
+	wantLinknames := []string{"", "", "", "etc/hosts", "/etc/hosts"}
+	if !reflect.DeepEqual(names, wantNames) || !reflect.DeepEqual(linknames, wantLinknames) {
+		t.Errorf("want names %q linknames %q, got %q %q", wantNames, wantLinknames, names, linknames)
+	}
+}